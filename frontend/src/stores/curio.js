@@ -40,6 +40,33 @@ export const useCurioStore = defineStore('curio', {
          }
       },
 
+      async getArchivematicaChildren( key, offset ) {
+         const url = `/api/view/${this.pid}/archivematica/node/${encodeURIComponent(key)}?offset=${offset}`
+         const { error, data } = await useFetch(url)
+         if ( error.value ) {
+            return null
+         }
+         return JSON.parse(data.value)
+      },
+
+      async getArchivematicaPreview( key ) {
+         const url = `/api/view/${this.pid}/archivematica/preview/${encodeURIComponent(key)}`
+         const { error, data } = await useFetch(url)
+         if ( error.value ) {
+            return null
+         }
+         return JSON.parse(data.value)
+      },
+
+      async searchArchivematica( query ) {
+         const url = `/api/view/${this.pid}/archivematica/search?q=${encodeURIComponent(query)}`
+         const { error, data } = await useFetch(url)
+         if ( error.value ) {
+            return null
+         }
+         return JSON.parse(data.value)
+      },
+
       clearAdvisory() {
          this.advisoryCleared = true
       },
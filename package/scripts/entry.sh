@@ -1,7 +1,8 @@
 # run application
 
 # run from here, since application expects web template in web/
-cd bin; ./curio \
+# exec so that curio receives SIGTERM directly and can shut down gracefully
+cd bin; exec ./curio \
   -apollo $APOLLO_URL \
   -iiif $CURIO_IIIF_MAN_URL \
   -rights $RIGHTS_WRAPPER_URL \
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requireAdmin protects the admin routes with the configured admin token, which must be sent as
+// a bearer token. When no token is configured the admin routes are disabled.
+func requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if config.adminToken == "" {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.adminToken)) != 1 {
+			slog.WarnContext(c.Request.Context(), "admin request rejected", "path", c.Request.URL.Path, "client_ip", c.ClientIP())
+			c.Header("WWW-Authenticate", `Bearer realm="curio"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+//
+// end of file
+//
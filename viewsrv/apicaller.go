@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"time"
@@ -51,32 +53,69 @@ type wslsMetadata struct {
 // use a shared client, 5 second connect, 15 second read timeout
 var httpClient = httpClientWithTimeouts(5, 15)
 
-// getAPIResponse calls a JSON endpoint and returns the response
-func getAPIResponse(url string) (string, error) {
-	log.Printf("INFO: GET %s", url)
-	resp, err := httpClient.Get(url)
+// getAPIResponse calls a JSON endpoint and returns the response, using the response cache when enabled
+func getAPIResponse(ctx context.Context, backend *upstream, url string) (string, error) {
+	resp, err := cachedResponse(ctx, "api:"+url, func() ([]byte, error) {
+		respString, err := fetchAPIResponse(ctx, backend, url)
+		return []byte(respString), err
+	})
 	if err != nil {
-		log.Printf("ERROR: %s returns %s", url, err.Error())
 		return "", err
 	}
+	return string(resp), nil
+}
+
+// fetchAPIResponse calls a JSON endpoint and returns the response without consulting the response cache
+func fetchAPIResponse(ctx context.Context, backend *upstream, url string) (string, error) {
+	var respString string
+	err := backend.call(ctx, url, func(ctx context.Context) error {
+		var err error
+		respString, err = fetchAPIResponseOnce(ctx, backend, url)
+		return err
+	})
+	return respString, err
+}
+
+// fetchAPIResponseOnce makes a single attempt to call a JSON endpoint
+func fetchAPIResponseOnce(ctx context.Context, backend *upstream, url string) (string, error) {
+	slog.InfoContext(ctx, "upstream request", "backend", backend.name, "url", url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", &UpstreamError{Backend: backend.name, URL: url, Err: err}
+	}
+	if id := requestID(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "upstream request failed", "backend", backend.name, "url", url, "error", err.Error())
+		return "", &UpstreamError{Backend: backend.name, URL: url, Err: err}
+	}
 	defer resp.Body.Close()
 	bodyBytes, _ := ioutil.ReadAll(resp.Body)
 	respString := string(bodyBytes)
 	if resp.StatusCode != http.StatusOK {
-		logLevel := "ERROR"
+		logLevel := slog.LevelError
 		// some errors are expected
 		if resp.StatusCode == http.StatusNotFound {
-			logLevel = "INFO"
+			logLevel = slog.LevelInfo
 		}
-		log.Printf("%s: %s returns %d (%s)", logLevel, url, resp.StatusCode, respString)
-		return "", errors.New(respString)
+		slog.Log(ctx, logLevel, "upstream request unsuccessful", "backend", backend.name, "url", url, "status", resp.StatusCode, "response", respString)
+		return "", &UpstreamError{Backend: backend.name, URL: url, StatusCode: resp.StatusCode, Err: errors.New(respString)}
 	}
 	return respString, nil
 }
 
-func getApolloWSLSMetadata(pid string) (*wslsMetadata, error) {
-	metadataURL := fmt.Sprintf("%s/items/%s", config.apolloURL, pid)
-	metadataJSON, err := getAPIResponse(metadataURL)
+// apolloItemURL is the Apollo API URL for an item
+func apolloItemURL(pid string) string {
+	return fmt.Sprintf("%s/items/%s", config.apolloURL, pid)
+}
+
+func getApolloWSLSMetadata(ctx context.Context, pid string) (wsls *wslsMetadata, err error) {
+	ctx, span := startSpan(ctx, "apollo.item", attribute.String("curio.pid", pid))
+	defer func() { endSpan(span, err) }()
+
+	metadataJSON, err := getAPIResponse(ctx, apolloBackend, apolloItemURL(pid))
 	if err != nil {
 		return nil, err
 	}
@@ -111,7 +150,7 @@ func httpClientWithTimeouts(connTimeout int, readTimeout int) *http.Client {
 
 	client := &http.Client{
 		Timeout: time.Duration(readTimeout) * time.Second,
-		Transport: &http.Transport{
+		Transport: otelhttp.NewTransport(&http.Transport{
 			DialContext: (&net.Dialer{
 				Timeout:   time.Duration(connTimeout) * time.Second,
 				KeepAlive: 60 * time.Second,
@@ -119,35 +158,46 @@ func httpClientWithTimeouts(connTimeout int, readTimeout int) *http.Client {
 			MaxIdleConns:        100,
 			MaxIdleConnsPerHost: 100,
 			IdleConnTimeout:     90 * time.Second,
-		},
+		}),
 	}
 
 	return client
 }
 
-// curio s3 session
-var s3Svc uva_s3.UvaS3
+// getStoredObject gets the contents of an object in the Archivematica store, using the response cache when enabled
+func getStoredObject(ctx context.Context, key string) (buf []byte, err error) {
+	ctx, span := startSpan(ctx, "storage.get", attribute.String("curio.storage.url", store.URL(key)))
+	defer func() { endSpan(span, err) }()
 
-func initS3() {
-	var err error
-	// load our AWS s3 helper object
-	s3Svc, err = uva_s3.NewUvaS3(uva_s3.UvaS3Config{Logging: true})
-	if err != nil {
-		log.Fatalf("FATAL ERROR: %s", err.Error())
-	}
+	return cachedResponse(ctx, "store:"+store.URL(key), func() ([]byte, error) {
+		return fetchStoredObject(ctx, key)
+	})
 }
 
-func getS3Response(bucket string, key string) ([]byte, error) {
-
-	input := uva_s3.NewUvaS3Object(bucket, key)
-	buffer, err := s3Svc.GetToBuffer(input)
+// fetchStoredObject gets the contents of a stored object without consulting the response cache
+func fetchStoredObject(ctx context.Context, key string) ([]byte, error) {
+	var buf []byte
+	err := storageBackend.call(ctx, store.URL(key), func(ctx context.Context) error {
+		var err error
+		buf, err = fetchStoredObjectOnce(ctx, key)
+		return err
+	})
+	return buf, err
+}
 
+// fetchStoredObjectOnce makes a single attempt to get the contents of a stored object
+func fetchStoredObjectOnce(ctx context.Context, key string) ([]byte, error) {
+	slog.InfoContext(ctx, "upstream request", "backend", storageBackend.name, "store", store.Name(), "url", store.URL(key))
+	buf, err := store.GetObject(ctx, key)
 	if err != nil {
-		fmt.Println(err.Error())
+		logLevel := slog.LevelError
+		if isNotFound(err) {
+			logLevel = slog.LevelInfo
+		}
+		slog.Log(ctx, logLevel, "upstream request unsuccessful", "backend", storageBackend.name, "store", store.Name(), "error", err.Error())
 		return nil, err
 	}
-
-	return buffer, nil
+	return buf, nil
 }
 
 //
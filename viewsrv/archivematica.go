@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// treeProblem is a single reason an Archivematica tree is invalid. Path locates the node, like
+// $.entries[2].entries[0]
+type treeProblem struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// InvalidTreeError is returned when an Archivematica tree can not be displayed. The PID exists, so
+// this is reported to the client as a 422 with the problems found.
+type InvalidTreeError struct {
+	URL      string
+	Problems []treeProblem
+}
+
+func (e *InvalidTreeError) Error() string {
+	msgs := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", p.Path, p.Message))
+	}
+	return fmt.Sprintf("invalid archivematica tree %s: %s", e.URL, strings.Join(msgs, "; "))
+}
+
+// parseArchivematicaTree decodes and validates an Archivematica tree, returning an *InvalidTreeError
+// describing everything wrong with it
+func parseArchivematicaTree(treeURL string, data []byte) (ArchivematicaS3Node, error) {
+	var root ArchivematicaS3Node
+	if err := json.Unmarshal(data, &root); err != nil {
+		return root, &InvalidTreeError{URL: treeURL, Problems: []treeProblem{decodeProblem(err)}}
+	}
+	problems := validateNode(root, "$", make([]treeProblem, 0))
+	if len(problems) > 0 {
+		return root, &InvalidTreeError{URL: treeURL, Problems: problems}
+	}
+	return root, nil
+}
+
+// decodeProblem describes why a document could not be decoded at all
+func decodeProblem(err error) treeProblem {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return treeProblem{Path: "$", Message: fmt.Sprintf("malformed JSON at offset %d: %s", syntaxErr.Offset, syntaxErr.Error())}
+	case errors.As(err, &typeErr):
+		path := "$"
+		if typeErr.Field != "" {
+			path += "." + typeErr.Field
+		}
+		return treeProblem{Path: path, Message: fmt.Sprintf("expected %s but found %s", typeErr.Type.String(), typeErr.Value)}
+	}
+	return treeProblem{Path: "$", Message: err.Error()}
+}
+
+// validateNode checks a node and everything below it
+func validateNode(node ArchivematicaS3Node, path string, problems []treeProblem) []treeProblem {
+	if node.Name == "" && node.ID == "" {
+		problems = append(problems, treeProblem{Path: path, Message: "node has neither a name nor an id"})
+	}
+	if node.Size < 0 {
+		problems = append(problems, treeProblem{Path: path, Message: fmt.Sprintf("negative size %d", node.Size)})
+	}
+	switch node.Type {
+	case "", "folder":
+	case "file":
+		if len(node.Entries) > 0 {
+			problems = append(problems, treeProblem{Path: path, Message: "file has entries"})
+		}
+	default:
+		problems = append(problems, treeProblem{Path: path, Message: fmt.Sprintf("unknown type %q", node.Type)})
+	}
+	for idx, child := range node.Entries {
+		problems = validateNode(child, fmt.Sprintf("%s.entries[%d]", path, idx), problems)
+	}
+	return problems
+}
+
+// treeWarnings finds problems that do not stop a tree being shown, like a checksum with no type,
+// which is passed through as is but can not be used to check the file
+func treeWarnings(node ArchivematicaS3Node, path string, warnings []treeProblem) []treeProblem {
+	if node.Checksum != "" && node.ChecksumType == "" {
+		warnings = append(warnings, treeProblem{Path: path, Message: "checksum has no checksum_type"})
+	}
+	for idx, child := range node.Entries {
+		warnings = treeWarnings(child, fmt.Sprintf("%s.entries[%d]", path, idx), warnings)
+	}
+	return warnings
+}
+
+// reportInvalidTree logs and counts an invalid tree so the bad object can be found and fixed
+func reportInvalidTree(ctx context.Context, pid string, err *InvalidTreeError) {
+	invalidTrees.Inc()
+	slog.ErrorContext(ctx, "invalid archivematica tree", "pid", pid, "url", err.URL, "problems", len(err.Problems), "error", err.Error())
+}
+
+// archivematicaKey is the key of the tree for a PID in the Archivematica store
+func archivematicaKey(pid string) string {
+	return fmt.Sprintf("%s.json", pid)
+}
+
+// archivematicaTree is a parsed and validated tree along with an index of its nodes by key, so a
+// request for one node does not have to walk the tree and hash every path
+type archivematicaTree struct {
+	root  ArchivematicaS3Node
+	nodes map[string]indexedNode
+	size  int64
+}
+
+// indexedNode is where a node is in a tree, and the key of its parent folder
+type indexedNode struct {
+	node   *ArchivematicaS3Node
+	path   string
+	depth  int
+	parent string
+}
+
+// newArchivematicaTree indexes a tree. Size is the size of the JSON it was parsed from.
+func newArchivematicaTree(root ArchivematicaS3Node, size int64) *archivematicaTree {
+	tree := &archivematicaTree{root: root, nodes: make(map[string]indexedNode), size: size}
+	walkTree(&tree.root, func(node *ArchivematicaS3Node, path string, depth int, ancestors []pathEntry) bool {
+		entry := indexedNode{node: node, path: path, depth: depth}
+		if len(ancestors) > 0 {
+			entry.parent = ancestors[len(ancestors)-1].Key
+		}
+		tree.nodes[nodeKey(path)] = entry
+		return true
+	})
+	return tree
+}
+
+// find returns the location of the node with a key, including the folders leading to it
+func (tree *archivematicaTree) find(key string) (treeLocation, bool) {
+	entry, ok := tree.nodes[key]
+	if !ok {
+		return treeLocation{}, false
+	}
+	loc := treeLocation{node: entry.node, path: entry.path, depth: entry.depth, ancestors: make([]pathEntry, entry.depth)}
+	for idx, parent := entry.depth-1, entry.parent; idx >= 0; idx-- {
+		folder := tree.nodes[parent]
+		loc.ancestors[idx] = pathEntry{Key: parent, Name: folder.node.Name}
+		parent = folder.parent
+	}
+	return loc, true
+}
+
+// parsed trees, by PID. Trees are shared between requests and must not be modified.
+var treeCache *ttlCache[*archivematicaTree]
+
+// initTreeCache creates the cache of parsed trees. It is turned off along with the response cache,
+// as trees would otherwise be reused when upstream responses are not.
+func initTreeCache() {
+	maxSize := config.treeCacheSize
+	if config.responseCache == "" || config.responseCache == "none" {
+		maxSize = 0
+	}
+	sizeOf := func(tree *archivematicaTree) int64 { return tree.size }
+	treeCache = newSizedTTLCache[*archivematicaTree](maxSize, config.treeCacheBytes, sizeOf)
+}
+
+// getArchivematicaTree gets the validated and indexed Archivematica tree for a PID
+func getArchivematicaTree(ctx context.Context, pid string) (*archivematicaTree, error) {
+	if tree, ok := treeCache.get(pid); ok {
+		observeCacheLookup("tree", true)
+		return tree, nil
+	}
+	observeCacheLookup("tree", false)
+
+	key := archivematicaKey(pid)
+	resp, err := getStoredObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	root, err := parseArchivematicaTree(store.URL(key), resp)
+	if err != nil {
+		var treeErr *InvalidTreeError
+		if errors.As(err, &treeErr) {
+			reportInvalidTree(ctx, pid, treeErr)
+		}
+		return nil, err
+	}
+	if warnings := treeWarnings(root, "$", make([]treeProblem, 0)); len(warnings) > 0 {
+		slog.WarnContext(ctx, "archivematica tree has problems", "pid", pid, "url", store.URL(key), "problems", len(warnings),
+			"first", fmt.Sprintf("%s: %s", warnings[0].Path, warnings[0].Message))
+	}
+	tree := newArchivematicaTree(root, int64(len(resp)))
+	treeCache.set(pid, tree, time.Duration(config.treeCacheTTL)*time.Second)
+	return tree, nil
+}
+
+// pathEscaper escapes the characters that have a meaning in a path: the separator, the ~ that
+// numbers repeated names, and the escape character itself
+var pathEscaper = strings.NewReplacer("%", "%25", "/", "%2F", "~", "%7E")
+
+// pathElement is how a node appears in a path: its ID, or its name if it has no ID. Slashes and
+// tildes are escaped so a name can not be confused with the separator or a numbered repeat.
+func pathElement(node ArchivematicaS3Node) string {
+	elem := node.ID
+	if elem == "" {
+		elem = node.Name
+	}
+	return pathEscaper.Replace(elem)
+}
+
+// rootPath is the path of the root of a tree
+func rootPath(root ArchivematicaS3Node) string {
+	return "/" + pathElement(root)
+}
+
+// childPaths are the paths of the children of a node. A child that has the same name as an earlier
+// sibling is numbered, like objects~2, so every node in a tree has a different path.
+func childPaths(parentPath string, node ArchivematicaS3Node) []string {
+	paths := make([]string, len(node.Entries))
+	seen := make(map[string]int)
+	for idx, child := range node.Entries {
+		elem := pathElement(child)
+		seen[elem]++
+		if seen[elem] > 1 {
+			elem = fmt.Sprintf("%s~%d", elem, seen[elem])
+		}
+		paths[idx] = parentPath + "/" + elem
+	}
+	return paths
+}
+
+// nodeKey is the key identifying a node: a hash of its path, so it is the same every time the tree
+// is loaded and safe to use in a URL
+func nodeKey(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:10])
+}
+
+// treeVisitor is called for each node as a tree is walked. Ancestors are the folders leading to the
+// node from the root. Returning false stops the walk.
+type treeVisitor func(node *ArchivematicaS3Node, path string, depth int, ancestors []pathEntry) bool
+
+// walkTree visits every node of a tree in order
+func walkTree(root *ArchivematicaS3Node, visit treeVisitor) {
+	walkNode(root, rootPath(*root), 0, make([]pathEntry, 0), visit)
+}
+
+func walkNode(node *ArchivematicaS3Node, path string, depth int, ancestors []pathEntry, visit treeVisitor) bool {
+	if !visit(node, path, depth, ancestors) {
+		return false
+	}
+	ancestors = append(ancestors, pathEntry{Key: nodeKey(path), Name: node.Name})
+	for idx, childPath := range childPaths(path, *node) {
+		if !walkNode(&node.Entries[idx], childPath, depth+1, ancestors, visit) {
+			return false
+		}
+	}
+	return true
+}
+
+// treeLocation is where a node was found in a tree
+type treeLocation struct {
+	node      *ArchivematicaS3Node
+	path      string
+	depth     int
+	ancestors []pathEntry
+}
+
+// rollup counts the files below a folder and adds up their sizes
+func rollup(node ArchivematicaS3Node) (int, int64) {
+	files := 0
+	var size int64
+	for _, child := range node.Entries {
+		if len(child.Entries) > 0 {
+			childFiles, childSize := rollup(child)
+			files += childFiles
+			size += childSize
+			continue
+		}
+		if child.Type != "folder" {
+			files++
+			size += child.Size
+		}
+	}
+	return files, size
+}
+
+// pageBounds is the slice of a list of total items covered by a page
+func pageBounds(total int, offset int, limit int) (int, int) {
+	start := offset
+	if start < 0 {
+		start = 0
+	}
+	if start > total {
+		start = total
+	}
+	end := total
+	if limit > 0 && start+limit < total {
+		end = start + limit
+	}
+	return start, end
+}
+
+// pageParams reads the offset and limit query params; the limit defaults to, and is capped at, maxLimit
+func pageParams(c *gin.Context, maxLimit int) (int, int) {
+	offset, err := strconv.Atoi(c.Query("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 || limit > maxLimit {
+		limit = maxLimit
+	}
+	return offset, limit
+}
+
+// nodePage is a page of the children of one folder, along with the folders that lead to it
+type nodePage struct {
+	Key      string      `json:"key"`
+	Path     []pathEntry `json:"path"`
+	Total    int         `json:"total"`
+	Offset   int         `json:"offset"`
+	Limit    int         `json:"limit"`
+	Children []TableNode `json:"children"`
+}
+
+// archivematicaNodeHandler returns a page of the children of a folder so the tree can be loaded as
+// it is expanded. Children are returned without their own children, marked with hasChildren. The
+// path to the node is included so a deep link can open the tree expanded to it.
+func archivematicaNodeHandler(c *gin.Context) {
+	pid := c.Param("pid")
+	key := c.Param("key")
+	c.Set(viewTypeKey, "archivematica")
+	tree, err := getArchivematicaTree(c.Request.Context(), pid)
+	if err != nil {
+		respondViewError(c, pid, err)
+		return
+	}
+	loc, ok := tree.find(key)
+	if !ok {
+		c.String(http.StatusNotFound, "not found")
+		return
+	}
+
+	offset, limit := pageParams(c, config.treePageSize)
+	start, end := pageBounds(len(loc.node.Entries), offset, limit)
+	page := nodePage{Key: key, Path: loc.ancestors, Total: len(loc.node.Entries), Offset: start, Limit: limit, Children: make([]TableNode, 0)}
+	paths := childPaths(loc.path, *loc.node)
+	for idx := start; idx < end; idx++ {
+		page.Children = append(page.Children, transformNode(loc.node.Entries[idx], paths[idx], loc.depth+1, loc.depth+1))
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// pathEntry is one of the ancestors of a node
+type pathEntry struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+}
+
+// searchResult is a node that matched a search, with the folders that lead to it from the root
+type searchResult struct {
+	Node TableNode   `json:"node"`
+	Path []pathEntry `json:"path"`
+}
+
+// searchResults is a page of the nodes that matched a search
+type searchResults struct {
+	Query   string         `json:"query"`
+	Total   int            `json:"total"`
+	Offset  int            `json:"offset"`
+	Limit   int            `json:"limit"`
+	Results []searchResult `json:"results"`
+}
+
+// archivematicaSearchHandler searches the names, formats and MIME types of every node in a tree
+func archivematicaSearchHandler(c *gin.Context) {
+	pid := c.Param("pid")
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.String(http.StatusBadRequest, "q is required")
+		return
+	}
+	c.Set(viewTypeKey, "archivematica")
+	tree, err := getArchivematicaTree(c.Request.Context(), pid)
+	if err != nil {
+		respondViewError(c, pid, err)
+		return
+	}
+
+	offset, limit := pageParams(c, config.searchLimit)
+	out := searchResults{Query: query, Offset: offset, Limit: limit, Results: make([]searchResult, 0)}
+	lowerQuery := strings.ToLower(query)
+	walkTree(&tree.root, func(node *ArchivematicaS3Node, path string, depth int, ancestors []pathEntry) bool {
+		if !nodeMatches(*node, lowerQuery) {
+			return true
+		}
+		if out.Total >= offset && len(out.Results) < limit {
+			result := searchResult{Node: transformNode(*node, path, depth, depth), Path: append([]pathEntry{}, ancestors...)}
+			out.Results = append(out.Results, result)
+		}
+		out.Total++
+		return true
+	})
+	slog.InfoContext(c.Request.Context(), "archivematica search", "pid", pid, "query", query, "matches", out.Total)
+	c.JSON(http.StatusOK, out)
+}
+
+// nodeMatches is true if the name, format or MIME type of a node contains the lower case query
+func nodeMatches(node ArchivematicaS3Node, query string) bool {
+	return strings.Contains(strings.ToLower(node.Name), query) ||
+		strings.Contains(strings.ToLower(node.Format), query) ||
+		strings.Contains(strings.ToLower(node.MimeType), query)
+}
+
+// validateTrees checks every tree in the Archivematica store and prints the problems with each
+// invalid one. It returns the process exit status: 0 if every tree is valid.
+func validateTrees(ctx context.Context) int {
+	keys, err := store.List(ctx)
+	if err != nil {
+		fmt.Printf("unable to list %s: %s\n", storeLocation(), err.Error())
+		return 2
+	}
+
+	checked := 0
+	invalid := 0
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".json") {
+			continue
+		}
+		checked++
+		data, err := store.GetObject(ctx, key)
+		var root ArchivematicaS3Node
+		if err == nil {
+			root, err = parseArchivematicaTree(store.URL(key), data)
+		}
+		if err == nil {
+			for _, p := range treeWarnings(root, "$", make([]treeProblem, 0)) {
+				fmt.Printf("%s: %s: warning: %s\n", store.URL(key), p.Path, p.Message)
+			}
+			continue
+		}
+		invalid++
+		var treeErr *InvalidTreeError
+		if !errors.As(err, &treeErr) {
+			fmt.Printf("%s: %s\n", store.URL(key), err.Error())
+			continue
+		}
+		for _, p := range treeErr.Problems {
+			fmt.Printf("%s: %s: %s\n", treeErr.URL, p.Path, p.Message)
+		}
+	}
+
+	fmt.Printf("checked %d trees in %s, %d invalid\n", checked, storeLocation(), invalid)
+	if invalid > 0 {
+		return 1
+	}
+	return 0
+}
+
+//
+// end of file
+//
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testTree is a small tree with nested and repeated folder names
+func testTree() ArchivematicaS3Node {
+	file := func(name string) ArchivematicaS3Node {
+		return ArchivematicaS3Node{Name: name, Type: "file", SourceURL: "https://files.example.org/" + name, Size: 10}
+	}
+	folder := func(name string, entries ...ArchivematicaS3Node) ArchivematicaS3Node {
+		return ArchivematicaS3Node{Name: name, Type: "folder", Entries: entries}
+	}
+	return folder("collection",
+		folder("objects",
+			folder("letters", file("a.txt"), file("b.txt"),
+				folder("drafts", file("a.txt"))),
+			file("photo.jpg")),
+		folder("objects", file("c.csv")),
+		folder("metadata", file("mets.xml")),
+	)
+}
+
+func TestArchivematicaTreeFind(t *testing.T) {
+	tree := newArchivematicaTree(testTree(), 100)
+
+	walked := 0
+	walkTree(&tree.root, func(node *ArchivematicaS3Node, path string, depth int, ancestors []pathEntry) bool {
+		walked++
+		loc, ok := tree.find(nodeKey(path))
+		if !ok {
+			t.Errorf("%s is not in the index", path)
+			return true
+		}
+		if loc.node != node || loc.path != path || loc.depth != depth {
+			t.Errorf("find %s = %s at depth %d", path, loc.path, loc.depth)
+		}
+		if !reflect.DeepEqual(loc.ancestors, ancestors) {
+			t.Errorf("find %s ancestors = %v, want %v", path, loc.ancestors, ancestors)
+		}
+		return true
+	})
+	if walked != len(tree.nodes) {
+		t.Errorf("index has %d nodes, tree has %d", len(tree.nodes), walked)
+	}
+
+	if _, ok := tree.find("0000"); ok {
+		t.Errorf("found a key that is not in the tree")
+	}
+}
+
+func TestArchivematicaTreeCache(t *testing.T) {
+	config.responseCache = "none"
+	config.treeCacheSize = 10
+	config.treeCacheBytes = 150
+	initTreeCache()
+	treeCache.set("am:1", newArchivematicaTree(testTree(), 100), time.Minute)
+	if _, ok := treeCache.get("am:1"); ok {
+		t.Errorf("trees should not be cached when response caching is off")
+	}
+
+	config.responseCache = "memory"
+	initTreeCache()
+
+	treeCache.set("am:1", newArchivematicaTree(testTree(), 100), time.Minute)
+	treeCache.set("am:2", newArchivematicaTree(testTree(), 100), time.Minute)
+	if _, ok := treeCache.get("am:1"); ok {
+		t.Errorf("am:1 should be evicted when the trees are over the byte budget")
+	}
+	if _, ok := treeCache.get("am:2"); !ok {
+		t.Errorf("am:2 should be cached")
+	}
+	treeCache.set("am:3", newArchivematicaTree(testTree(), 200), time.Minute)
+	if _, ok := treeCache.get("am:3"); ok {
+		t.Errorf("a tree bigger than the budget should not be cached")
+	}
+}
+
+func TestChildPathsAreUnique(t *testing.T) {
+	tests := []struct {
+		name  string
+		names []string
+	}{
+		{"repeated", []string{"objects", "objects", "objects"}},
+		{"numbered name", []string{"objects", "objects", "objects~2"}},
+		{"escaped name", []string{"a/b", "a%2Fb", "a%252Fb"}},
+		{"escaped tilde", []string{"x~2", "x%7E2", "x", "x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := ArchivematicaS3Node{Name: "root", Type: "folder"}
+			for _, name := range tt.names {
+				parent.Entries = append(parent.Entries, ArchivematicaS3Node{Name: name, Type: "file"})
+			}
+			seen := make(map[string]bool)
+			for _, path := range childPaths("/root", parent) {
+				if seen[path] {
+					t.Errorf("%v gives the path %s twice", tt.names, path)
+				}
+				seen[path] = true
+			}
+		})
+	}
+}
+
+func TestChecksumWithoutTypeIsAWarning(t *testing.T) {
+	data := `{"name": "t", "type": "folder", "entries": [
+		{"name": "a.txt", "type": "file", "checksum": "abc"},
+		{"name": "b.txt", "type": "file", "checksum": "def", "checksum_type": "md5"}]}`
+	root, err := parseArchivematicaTree("memory:///t.json", []byte(data))
+	if err != nil {
+		t.Fatalf("tree with a checksum and no type should be valid: %v", err)
+	}
+	warnings := treeWarnings(root, "$", make([]treeProblem, 0))
+	if len(warnings) != 1 || warnings[0].Path != "$.entries[0]" {
+		t.Errorf("warnings = %v", warnings)
+	}
+}
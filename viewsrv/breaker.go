@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned without calling a backend when its circuit breaker is open
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// circuitBreaker stops calls to a backend after a run of consecutive failures. Once the cooldown
+// has passed a single trial call is let through (half-open); if it succeeds the circuit closes,
+// otherwise it opens again.
+type circuitBreaker struct {
+	lock      sync.Mutex
+	state     string
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	openedAt  time.Time
+	trialSent bool
+}
+
+// circuitStatus is the externally visible state of a circuit breaker
+type circuitStatus struct {
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{state: circuitClosed, threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns errCircuitOpen if a call should not be made now
+func (cb *circuitBreaker) allow() error {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return errCircuitOpen
+		}
+		cb.state = circuitHalfOpen
+		cb.trialSent = true
+		return nil
+	case circuitHalfOpen:
+		if cb.trialSent {
+			return errCircuitOpen
+		}
+		cb.trialSent = true
+	}
+	return nil
+}
+
+// success records a call that reached a working backend
+func (cb *circuitBreaker) success() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.state = circuitClosed
+	cb.failures = 0
+	cb.trialSent = false
+}
+
+// failure records a call that failed because the backend is broken or unreachable
+func (cb *circuitBreaker) failure() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.failures++
+	if cb.state == circuitHalfOpen || (cb.threshold > 0 && cb.failures >= cb.threshold) {
+		cb.state = circuitOpen
+		cb.openedAt = time.Now()
+		cb.trialSent = false
+	}
+}
+
+// abandon releases a trial call that ended without telling us anything about the backend,
+// such as when the client went away
+func (cb *circuitBreaker) abandon() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.state == circuitHalfOpen {
+		cb.trialSent = false
+	}
+}
+
+func (cb *circuitBreaker) status() circuitStatus {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	out := circuitStatus{State: cb.state, Failures: cb.failures}
+	if cb.state == circuitOpen && time.Since(cb.openedAt) >= cb.cooldown {
+		out.State = circuitHalfOpen
+	}
+	if cb.state != circuitClosed {
+		openedAt := cb.openedAt
+		out.OpenedAt = &openedAt
+	}
+	return out
+}
+
+//
+// end of file
+//
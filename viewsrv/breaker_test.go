@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerCycle(t *testing.T) {
+	cb := newCircuitBreaker(2, 20*time.Millisecond)
+
+	cb.failure()
+	if err := cb.allow(); err != nil || cb.status().State != circuitClosed {
+		t.Fatalf("one failure below the threshold: allow = %v, state = %s", err, cb.status().State)
+	}
+	cb.failure()
+	if err := cb.allow(); !errors.Is(err, errCircuitOpen) || cb.status().State != circuitOpen {
+		t.Fatalf("failures at the threshold: allow = %v, state = %s", err, cb.status().State)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if state := cb.status().State; state != circuitHalfOpen {
+		t.Fatalf("after the cooldown: state = %s, want %s", state, circuitHalfOpen)
+	}
+	if err := cb.allow(); err != nil {
+		t.Fatalf("trial call refused: %v", err)
+	}
+	if err := cb.allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("second call while the trial is out: allow = %v, want errCircuitOpen", err)
+	}
+
+	cb.success()
+	if err := cb.allow(); err != nil || cb.status().State != circuitClosed || cb.status().Failures != 0 {
+		t.Fatalf("after a successful trial: allow = %v, status = %+v", err, cb.status())
+	}
+}
+
+func TestCircuitBreakerFailedTrial(t *testing.T) {
+	cb := newCircuitBreaker(1, 20*time.Millisecond)
+	cb.failure()
+	time.Sleep(30 * time.Millisecond)
+	if err := cb.allow(); err != nil {
+		t.Fatalf("trial call refused: %v", err)
+	}
+	cb.failure()
+	if err := cb.allow(); !errors.Is(err, errCircuitOpen) || cb.status().State != circuitOpen {
+		t.Fatalf("after a failed trial: allow = %v, state = %s", err, cb.status().State)
+	}
+}
+
+func TestCircuitBreakerAbandon(t *testing.T) {
+	cb := newCircuitBreaker(1, 20*time.Millisecond)
+	cb.failure()
+	time.Sleep(30 * time.Millisecond)
+	if err := cb.allow(); err != nil {
+		t.Fatalf("trial call refused: %v", err)
+	}
+	cb.abandon()
+	if state := cb.status().State; state != circuitHalfOpen {
+		t.Fatalf("after an abandoned trial: state = %s, want %s", state, circuitHalfOpen)
+	}
+	if err := cb.allow(); err != nil {
+		t.Fatalf("abandoned trial was not released: allow = %v", err)
+	}
+
+	// abandoning a call made while closed leaves the breaker alone
+	cb = newCircuitBreaker(1, time.Minute)
+	cb.abandon()
+	if err := cb.allow(); err != nil || cb.status().State != circuitClosed {
+		t.Fatalf("abandon while closed: allow = %v, state = %s", err, cb.status().State)
+	}
+}
+
+func TestUpstreamCallRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		requests int
+	}{
+		{name: "server error is retried", status: http.StatusInternalServerError, requests: 3},
+		{name: "unavailable is retried", status: http.StatusServiceUnavailable, requests: 3},
+		{name: "not found is not retried", status: http.StatusNotFound, requests: 1},
+		{name: "not implemented is not retried", status: http.StatusNotImplemented, requests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			config.retries = 2
+			config.retryBackoff = 0
+			env.backend.Handle("/apollo/items/pid:1", tt.status, "text/plain", []byte("no"))
+
+			_, err := fetchAPIResponse(context.Background(), apolloBackend, apolloItemURL("pid:1"))
+			var upErr *UpstreamError
+			if !errors.As(err, &upErr) || upErr.StatusCode != tt.status {
+				t.Fatalf("call error = %v, want a %d", err, tt.status)
+			}
+			if n := env.backend.Requests("/apollo/items/pid:1"); n != tt.requests {
+				t.Errorf("backend called %d times, want %d", n, tt.requests)
+			}
+		})
+	}
+}
+
+func TestUpstreamCallStopsWhenCircuitOpens(t *testing.T) {
+	env := newTestEnv(t)
+	config.retries = 5
+	config.retryBackoff = 0
+	apolloBackend.breaker = newCircuitBreaker(2, time.Minute)
+	env.backend.Handle("/apollo/items/pid:1", http.StatusInternalServerError, "text/plain", []byte("boom"))
+
+	_, err := fetchAPIResponse(context.Background(), apolloBackend, apolloItemURL("pid:1"))
+	if !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("call error = %v, want errCircuitOpen", err)
+	}
+	if n := env.backend.Requests("/apollo/items/pid:1"); n != 2 {
+		t.Errorf("backend called %d times, want 2", n)
+	}
+}
+
+func TestUpstreamCallAbandonsCancelledTrial(t *testing.T) {
+	env := newTestEnv(t)
+	apolloBackend.breaker = newCircuitBreaker(1, 20*time.Millisecond)
+	apolloBackend.breaker.failure()
+	time.Sleep(30 * time.Millisecond)
+	env.backend.HandleSlow("/apollo/items/pid:1", 5*time.Second, `{}`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := fetchAPIResponse(ctx, apolloBackend, apolloItemURL("pid:1")); err == nil {
+		t.Fatalf("cancelled call succeeded")
+	}
+	if state := apolloBackend.breaker.status().State; state != circuitHalfOpen {
+		t.Fatalf("after a cancelled trial: state = %s, want %s", state, circuitHalfOpen)
+	}
+	if err := apolloBackend.breaker.allow(); err != nil {
+		t.Errorf("cancelled trial was not released: allow = %v", err)
+	}
+}
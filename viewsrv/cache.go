@@ -0,0 +1,207 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ttlCache is a size bounded, least recently used cache where every entry expires after a TTL.
+// It is safe for concurrent use.
+type ttlCache[V any] struct {
+	lock    sync.Mutex
+	maxSize int
+	order   *list.List
+	entries map[string]*list.Element
+
+	// when sizeOf is set the total size of the values is also kept under maxBytes
+	maxBytes int64
+	bytes    int64
+	sizeOf   func(V) int64
+}
+
+type ttlCacheEntry[V any] struct {
+	key     string
+	value   V
+	size    int64
+	expires time.Time
+}
+
+func newTTLCache[V any](maxSize int) *ttlCache[V] {
+	return &ttlCache[V]{maxSize: maxSize, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// newSizedTTLCache creates a cache that is bounded by the total size of its values as well as the
+// number of entries. A value bigger than maxBytes on its own is never cached.
+func newSizedTTLCache[V any](maxSize int, maxBytes int64, sizeOf func(V) int64) *ttlCache[V] {
+	tc := newTTLCache[V](maxSize)
+	tc.maxBytes = maxBytes
+	tc.sizeOf = sizeOf
+	return tc
+}
+
+// remove deletes an element; the lock must be held
+func (tc *ttlCache[V]) remove(elem *list.Element) {
+	entry := elem.Value.(*ttlCacheEntry[V])
+	tc.order.Remove(elem)
+	delete(tc.entries, entry.key)
+	tc.bytes -= entry.size
+}
+
+// get returns the unexpired value for a key
+func (tc *ttlCache[V]) get(key string) (V, bool) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	var empty V
+	elem, ok := tc.entries[key]
+	if !ok {
+		return empty, false
+	}
+	entry := elem.Value.(*ttlCacheEntry[V])
+	if time.Now().After(entry.expires) {
+		tc.remove(elem)
+		return empty, false
+	}
+	tc.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+// set adds or replaces the value for a key, evicting the least recently used entries if the cache is full
+func (tc *ttlCache[V]) set(key string, value V, ttl time.Duration) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if tc.maxSize <= 0 {
+		return
+	}
+	if elem, ok := tc.entries[key]; ok {
+		tc.remove(elem)
+	}
+	var size int64
+	if tc.sizeOf != nil {
+		size = tc.sizeOf(value)
+		if size > tc.maxBytes {
+			return
+		}
+	}
+	for tc.order.Len() > 0 && (tc.order.Len() >= tc.maxSize || (tc.sizeOf != nil && tc.bytes+size > tc.maxBytes)) {
+		tc.remove(tc.order.Back())
+	}
+	entry := &ttlCacheEntry[V]{key: key, value: value, size: size, expires: time.Now().Add(ttl)}
+	tc.entries[key] = tc.order.PushFront(entry)
+	tc.bytes += size
+}
+
+// removeIf removes all entries that match the supplied test and returns the count removed
+func (tc *ttlCache[V]) removeIf(match func(key string, value V) bool) int {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	removed := 0
+	for key, elem := range tc.entries {
+		if match(key, elem.Value.(*ttlCacheEntry[V]).value) {
+			tc.remove(elem)
+			removed++
+		}
+	}
+	return removed
+}
+
+// pidCacheEntry records what a PID resolved to. Negative entries record PIDs that no resolver recognized.
+type pidCacheEntry struct {
+	Found     bool
+	Resolver  string
+	SourceURL string
+}
+
+// global cache of PID resolutions
+var pidCache *ttlCache[pidCacheEntry]
+
+func initPIDCache() {
+	pidCache = newTTLCache[pidCacheEntry](config.cacheSize)
+}
+
+// pidCacheKey is the cache key for a PID; the unit is included as it can change how a PID resolves
+func pidCacheKey(pid string, unit string) string {
+	return pid + "|" + unit
+}
+
+func cachePIDResolution(pid string, params resolveParams, resolverName string, sourceURL string) {
+	entry := pidCacheEntry{Found: true, Resolver: resolverName, SourceURL: sourceURL}
+	pidCache.set(pidCacheKey(pid, params.Unit), entry, time.Duration(config.cacheTTL)*time.Second)
+}
+
+func cachePIDNotFound(pid string, params resolveParams) {
+	pidCache.set(pidCacheKey(pid, params.Unit), pidCacheEntry{Found: false}, time.Duration(config.negativeCacheTTL)*time.Second)
+}
+
+func getCachedPIDResolution(pid string, params resolveParams) (pidCacheEntry, bool) {
+	return pidCache.get(pidCacheKey(pid, params.Unit))
+}
+
+// purgePID removes all cached resolutions for a PID, regardless of unit, along with the upstream
+// responses cached for it. It returns the number of resolutions and responses removed.
+func purgePID(ctx context.Context, pid string) (int, int) {
+	prefix := pidCacheKey(pid, "")
+	sourceURLs := make(map[string]bool)
+	removed := pidCache.removeIf(func(key string, entry pidCacheEntry) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if entry.SourceURL != "" {
+			sourceURLs[entry.SourceURL] = true
+		}
+		return true
+	})
+	treeCache.removeIf(func(key string, _ *archivematicaTree) bool { return key == pid })
+
+	if respCache == nil {
+		return removed, 0
+	}
+	match := pidResponseMatcher(pid, sourceURLs)
+	responses, err := respCache.Remove(ctx, match)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to purge cached responses", "cache", respCache.Name(), "pid", pid, "error", err.Error())
+	}
+	return removed, responses
+}
+
+// pidResponseMatcher matches the response cache keys of everything fetched to view a PID: its IIIF
+// existence check and manifests, its Apollo item, its Archivematica tree and the source of any
+// cached resolution
+func pidResponseMatcher(pid string, sourceURLs map[string]bool) func(key string) bool {
+	iiifPrefix := "api:" + fmt.Sprintf("%s/pid/%s", config.iiifURL, pid)
+	exact := map[string]bool{
+		"api:" + apolloItemURL(pid): true,
+	}
+	if store != nil {
+		exact["store:"+store.URL(archivematicaKey(pid))] = true
+	}
+	for sourceURL := range sourceURLs {
+		exact["api:"+sourceURL] = true
+	}
+	return func(key string) bool {
+		if exact[key] {
+			return true
+		}
+		rest, ok := strings.CutPrefix(key, iiifPrefix)
+		return ok && (rest == "" || strings.HasPrefix(rest, "/") || strings.HasPrefix(rest, "?"))
+	}
+}
+
+// purgeCacheHandler removes a single PID from the resolution and response caches
+func purgeCacheHandler(c *gin.Context) {
+	pid := c.Param("pid")
+	removed, responses := purgePID(c.Request.Context(), pid)
+	slog.InfoContext(c.Request.Context(), "purged cache entries", "pid", pid, "count", removed, "responses", responses)
+	c.JSON(http.StatusOK, gin.H{"pid": pid, "purged": removed, "responses": responses})
+}
+
+//
+// end of file
+//
@@ -2,7 +2,19 @@ package main
 
 import (
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v2"
 )
 
 type configData struct {
@@ -13,6 +25,64 @@ type configData struct {
 	hostname            string
 	rightsURL           string
 	archivematicaBucket string
+	archivematicaStore  string
+	treeDepth           int
+	treePageSize        int
+	searchLimit         int
+	zipMaxBytes         int64
+	previewMaxBytes     int64
+	downloadIdleTimeout int
+	previewTimeout      int
+	s3Endpoint          string
+	s3PathStyle         bool
+	resolverOrder       string
+	disabledResolvers   string
+	cacheSize           int
+	cacheTTL            int
+	negativeCacheTTL    int
+	responseCache       string
+	responseCacheSize   int
+	responseCacheBytes  int64
+	responseCacheTTL    int
+	treeCacheSize       int
+	treeCacheBytes      int64
+	treeCacheTTL        int
+	iiifTimeout         int
+	apolloTimeout       int
+	rightsTimeout       int
+	wslsTimeout         int
+	s3Timeout           int
+	retries             int
+	retryBackoff        int
+	breakerThreshold    int
+	breakerCooldown     int
+	healthTimeout       int
+	criticalDeps        string
+	shutdownTimeout     int
+	shutdownDelay       int
+	logLevel            string
+	adminToken          string
+	traceExporter       string
+	otlpEndpoint        string
+	configFile          string
+	fixtureMode         string
+	fixtureDir          string
+
+	// identity and presentation of embedded views
+	providerName             string
+	providerURL              string
+	viewURLPattern           string
+	imageEmbedWidth          string
+	imageEmbedHeight         string
+	wslsEmbedWidth           string
+	wslsEmbedHeight          string
+	archivematicaEmbedWidth  string
+	archivematicaEmbedHeight string
+	wslsVideoPattern         string
+	wslsPosterPattern        string
+	wslsPDFPattern           string
+	wslsThumbPattern         string
+	wslsTranscriptPattern    string
 }
 
 // globals for the CFG
@@ -25,16 +95,255 @@ func getConfiguration() {
 	flag.StringVar(&config.wslsURL, "fedora", "https://wsls.lib.virginia.edu", "WSLS Fedora URL")
 	flag.StringVar(&config.rightsURL, "rights", "https://rights-wrapper.lib.virginia.edu/api/pid", "Rights wrapper URL")
 	flag.StringVar(&config.archivematicaBucket, "archivematicaBucket", "archivematica-curio-staging", "Archivematica S3 Bucket")
+	flag.StringVar(&config.archivematicaStore, "archivematicaStore", "", "Location of the Archivematica trees, like s3://bucket/prefix or file:///data/am (default the archivematica bucket)")
+	flag.IntVar(&config.treeDepth, "treeDepth", 2, "Levels of an Archivematica tree returned with the view; deeper folders are loaded on expand")
+	flag.IntVar(&config.treePageSize, "treePageSize", 500, "Max children of an Archivematica folder returned at once")
+	flag.IntVar(&config.searchLimit, "searchLimit", 100, "Max Archivematica search results returned at once")
+	flag.Int64Var(&config.zipMaxBytes, "zipMaxBytes", 2<<30, "Max bytes of files in an Archivematica ZIP download")
+	flag.Int64Var(&config.previewMaxBytes, "previewMaxBytes", 256<<10, "Max bytes of a text file returned as an Archivematica preview")
+	flag.IntVar(&config.previewTimeout, "previewTimeout", 10, "Seconds allowed to fetch the text of an Archivematica preview")
+	flag.IntVar(&config.downloadIdleTimeout, "downloadIdleTimeout", 30, "Seconds a file host may take to respond, or go without sending, before a ZIP download gives up on the file")
+	flag.StringVar(&config.s3Endpoint, "s3Endpoint", "", "Endpoint of an S3-compatible service such as MinIO, like http://minio:9000 (default AWS)")
+	flag.BoolVar(&config.s3PathStyle, "s3PathStyle", false, "Use path-style S3 URLs, as most S3-compatible services require")
+	flag.StringVar(&config.resolverOrder, "resolvers", "iiif,wsls,archivematica", "Comma separated list of resolvers in the order they are tried")
+	flag.StringVar(&config.disabledResolvers, "disable", "", "Comma separated list of resolvers to disable")
+	flag.IntVar(&config.cacheSize, "cacheSize", 10000, "Max number of PID resolutions to cache (0 to disable)")
+	flag.IntVar(&config.cacheTTL, "cacheTTL", 3600, "Seconds to cache a PID resolution")
+	flag.IntVar(&config.negativeCacheTTL, "negativeCacheTTL", 300, "Seconds to cache a PID that was not found")
+	flag.StringVar(&config.responseCache, "responseCache", "memory", "Upstream response cache: none, memory or redis://host:port/db")
+	flag.IntVar(&config.responseCacheSize, "responseCacheSize", 1000, "Max number of upstream responses to cache in memory")
+	flag.Int64Var(&config.responseCacheBytes, "responseCacheBytes", 128<<20, "Max total bytes of upstream responses to cache in memory; larger responses are not cached")
+	flag.IntVar(&config.responseCacheTTL, "responseCacheTTL", 300, "Seconds to cache an upstream response")
+	flag.IntVar(&config.treeCacheSize, "treeCacheSize", 50, "Max number of parsed Archivematica trees to cache (0 to disable)")
+	flag.Int64Var(&config.treeCacheBytes, "treeCacheBytes", 64<<20, "Max total size, as JSON, of the parsed Archivematica trees to cache; larger trees are not cached")
+	flag.IntVar(&config.treeCacheTTL, "treeCacheTTL", 300, "Seconds to cache a parsed Archivematica tree; trees are not cached when -responseCache is none")
+	flag.IntVar(&config.iiifTimeout, "iiifTimeout", 10, "Seconds allowed for a call to the IIIF manifest service")
+	flag.IntVar(&config.apolloTimeout, "apolloTimeout", 10, "Seconds allowed for a call to Apollo")
+	flag.IntVar(&config.rightsTimeout, "rightsTimeout", 5, "Seconds allowed for a call to the rights wrapper")
+	flag.IntVar(&config.wslsTimeout, "wslsTimeout", 5, "Seconds allowed for a call to WSLS Fedora")
+	flag.IntVar(&config.s3Timeout, "s3Timeout", 15, "Seconds allowed for a call to Archivematica storage")
+	flag.IntVar(&config.retries, "retries", 2, "Number of times a failed upstream call is retried")
+	flag.IntVar(&config.retryBackoff, "retryBackoff", 200, "Base milliseconds to wait before retrying a failed upstream call")
+	flag.IntVar(&config.breakerThreshold, "breakerThreshold", 5, "Consecutive upstream failures that open the circuit breaker")
+	flag.IntVar(&config.breakerCooldown, "breakerCooldown", 30, "Seconds an open circuit breaker waits before trying the backend again")
+	flag.IntVar(&config.healthTimeout, "healthTimeout", 5, "Seconds allowed for each dependency health check")
+	flag.StringVar(&config.criticalDeps, "criticalDeps", "iiifmanifest", "Comma separated list of dependencies that fail the healthcheck when unhealthy")
+	flag.IntVar(&config.shutdownTimeout, "shutdownTimeout", 30, "Seconds to wait for in-flight requests to finish on shutdown")
+	flag.IntVar(&config.shutdownDelay, "shutdownDelay", 5, "Seconds to keep serving after /readyz starts failing on shutdown")
+	flag.StringVar(&config.adminToken, "adminToken", "", "Bearer token required by the admin routes; they are disabled when empty")
+	flag.StringVar(&config.logLevel, "logLevel", "info", "Log level: debug, info, warn or error")
+	flag.StringVar(&config.traceExporter, "traceExporter", "none", "Trace exporter: none, stdout or otlp")
+	flag.StringVar(&config.otlpEndpoint, "otlpEndpoint", "", "OTLP/HTTP collector URL, like http://collector:4318/v1/traces")
 	flag.StringVar(&config.hostname, "host", "curio.lib.virginia.edu", "Curio hostname")
+	flag.StringVar(&config.providerName, "providerName", "UVA Library", "oEmbed provider name")
+	flag.StringVar(&config.providerURL, "providerURL", "http://www.library.virginia.edu/", "oEmbed provider URL")
+	flag.StringVar(&config.viewURLPattern, "viewURLPattern", "https://{host}/view/{pid}", "Public view URL; {host} is the Curio hostname and {pid} the PID")
+	flag.StringVar(&config.imageEmbedWidth, "imageEmbedWidth", "100%", "Default width of an embedded image view")
+	flag.StringVar(&config.imageEmbedHeight, "imageEmbedHeight", "600px", "Default height of an embedded image view")
+	flag.StringVar(&config.wslsEmbedWidth, "wslsEmbedWidth", "670px", "Default width of an embedded WSLS view")
+	flag.StringVar(&config.wslsEmbedHeight, "wslsEmbedHeight", "800px", "Default height of an embedded WSLS view")
+	flag.StringVar(&config.archivematicaEmbedWidth, "archivematicaEmbedWidth", "100%", "Default width of an embedded Archivematica view")
+	flag.StringVar(&config.archivematicaEmbedHeight, "archivematicaEmbedHeight", "600px", "Default height of an embedded Archivematica view")
+	flag.StringVar(&config.wslsVideoPattern, "wslsVideoPattern", "{id}/{id}.mp4", "WSLS video file, relative to the WSLS URL; {id} is the WSLS ID")
+	flag.StringVar(&config.wslsPosterPattern, "wslsPosterPattern", "{id}/{id}-poster.jpg", "WSLS poster file, relative to the WSLS URL")
+	flag.StringVar(&config.wslsPDFPattern, "wslsPDFPattern", "{id}/{id}.pdf", "WSLS anchor script PDF, relative to the WSLS URL")
+	flag.StringVar(&config.wslsThumbPattern, "wslsThumbPattern", "{id}/{id}-script-thumbnail.jpg", "WSLS anchor script thumbnail, relative to the WSLS URL")
+	flag.StringVar(&config.wslsTranscriptPattern, "wslsTranscriptPattern", "{id}/{id}.txt", "WSLS transcript, relative to the WSLS URL")
+	flag.StringVar(&config.fixtureMode, "fixtureMode", "off", "Fixture mode: off, record (save upstream responses) or replay (serve saved responses only)")
+	flag.StringVar(&config.fixtureDir, "fixtureDir", "fixtures", "Directory of recorded upstream responses used by the fixture mode")
+	flag.StringVar(&config.configFile, "config", "", "Optional YAML or TOML config file")
 	flag.Parse()
 
-	log.Printf("[CONFIG] port                  = [%d]", config.port)
-	log.Printf("[CONFIG] apolloURL             = [%s]", config.apolloURL)
-	log.Printf("[CONFIG] iiifURL               = [%s]", config.iiifURL)
-	log.Printf("[CONFIG] wslsURL               = [%s]", config.wslsURL)
-	log.Printf("[CONFIG] rightsURL             = [%s]", config.rightsURL)
-	log.Printf("[CONFIG] archivematicaBucket   = [%s]", config.archivematicaBucket)
-	log.Printf("[CONFIG] hostname              = [%s]", config.hostname)
+	if err := applyConfigSources(); err != nil {
+		initLogging(config.logLevel)
+		fatal("invalid configuration", "error", err.Error())
+	}
+	initLogging(config.logLevel)
+	if err := validateConfig(); err != nil {
+		fatal("invalid configuration", "error", err.Error())
+	}
+
+	for _, setting := range effectiveConfig() {
+		slog.Info("config", "name", setting.Name, "value", setting.Value, "source", setting.Source)
+	}
+}
+
+// envPrefix is the prefix of the environment variables that can set config values
+const envPrefix = "CURIO_"
+
+// the sources of a config value, in increasing order of precedence
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// configSources records where each config value came from
+var configSources = make(map[string]string)
+
+// envName is the environment variable for a flag; archivematicaBucket is CURIO_ARCHIVEMATICA_BUCKET
+func envName(flagName string) string {
+	var out strings.Builder
+	out.WriteString(envPrefix)
+	for i, r := range flagName {
+		if i > 0 && unicode.IsUpper(r) {
+			out.WriteRune('_')
+		}
+		out.WriteRune(unicode.ToUpper(r))
+	}
+	return out.String()
+}
+
+// applyConfigSources fills in every value not set on the command line. Precedence, highest first, is:
+// command line flags, CURIO_* environment variables, the config file and finally the flag defaults.
+func applyConfigSources() error {
+	flag.Visit(func(f *flag.Flag) {
+		configSources[f.Name] = sourceFlag
+	})
+
+	if config.configFile == "" {
+		config.configFile = os.Getenv(envName("config"))
+	}
+	fileValues, err := readConfigFile(config.configFile)
+	if err != nil {
+		return err
+	}
+
+	var applyErr error
+	flag.VisitAll(func(f *flag.Flag) {
+		if applyErr != nil || configSources[f.Name] == sourceFlag {
+			return
+		}
+		configSources[f.Name] = sourceDefault
+		if val, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := flag.Set(f.Name, val); err != nil {
+				applyErr = fmt.Errorf("%s: %s", envName(f.Name), err.Error())
+			}
+			configSources[f.Name] = sourceEnv
+			return
+		}
+		if val, ok := fileValues[f.Name]; ok {
+			if err := flag.Set(f.Name, val); err != nil {
+				applyErr = fmt.Errorf("%s in %s: %s", f.Name, config.configFile, err.Error())
+			}
+			configSources[f.Name] = sourceFile
+		}
+	})
+	return applyErr
+}
+
+// readConfigFile reads a flat YAML or TOML file where the keys are the flag names
+func readConfigFile(fileName string) (map[string]string, error) {
+	out := make(map[string]string)
+	if fileName == "" {
+		return out, nil
+	}
+	raw, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, &values)
+	case ".toml":
+		err = toml.Unmarshal(raw, &values)
+	default:
+		return nil, fmt.Errorf("config file %s must be .yaml, .yml or .toml", fileName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", fileName, err.Error())
+	}
+
+	for key, val := range values {
+		if flag.Lookup(key) == nil || key == "config" {
+			return nil, fmt.Errorf("unknown setting %s in %s", key, fileName)
+		}
+		out[key] = fmt.Sprint(val)
+	}
+	return out, nil
+}
+
+// validateConfig checks that the values that must be URLs are
+func validateConfig() error {
+	urls := map[string]string{
+		"apollo":         config.apolloURL,
+		"iiif":           config.iiifURL,
+		"fedora":         config.wslsURL,
+		"rights":         config.rightsURL,
+		"providerURL":    config.providerURL,
+		"viewURLPattern": viewURL("pid"),
+	}
+	if config.otlpEndpoint != "" {
+		urls["otlpEndpoint"] = config.otlpEndpoint
+	}
+	for name, val := range urls {
+		parsed, err := url.Parse(val)
+		if err != nil {
+			return fmt.Errorf("%s is not a valid URL: %s", name, err.Error())
+		}
+		if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("%s must be an absolute http or https URL: %s", name, val)
+		}
+	}
+	if config.port <= 0 || config.port > 65535 {
+		return fmt.Errorf("port %d is out of range", config.port)
+	}
+	if config.downloadIdleTimeout <= 0 {
+		return fmt.Errorf("downloadIdleTimeout must be at least 1 second")
+	}
+	if config.previewTimeout <= 0 {
+		return fmt.Errorf("previewTimeout must be at least 1 second")
+	}
+	return nil
+}
+
+// configSetting is one value of the effective configuration
+type configSetting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// effectiveConfig lists every config value with any secrets redacted
+func effectiveConfig() []configSetting {
+	out := make([]configSetting, 0)
+	flag.VisitAll(func(f *flag.Flag) {
+		source := configSources[f.Name]
+		if source == "" {
+			source = sourceDefault
+		}
+		out = append(out, configSetting{Name: f.Name, Value: redact(f.Name, f.Value.String()), Source: source})
+	})
+	return out
+}
+
+// sensitive setting names have their values fully redacted
+var sensitiveName = regexp.MustCompile(`(?i)password|secret|token|credential`)
+
+// redact hides secrets in a config value: the whole value of a sensitive setting, or the
+// password part of a URL
+func redact(name string, value string) string {
+	if value == "" {
+		return value
+	}
+	if sensitiveName.MatchString(name) {
+		return "REDACTED"
+	}
+	if parsed, err := url.Parse(value); err == nil && parsed.User != nil {
+		if _, hasPassword := parsed.User.Password(); hasPassword {
+			parsed.User = url.UserPassword(parsed.User.Username(), "REDACTED")
+			return parsed.String()
+		}
+	}
+	return value
+}
+
+// configHandler returns the effective configuration, with secrets redacted
+func configHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, effectiveConfig())
 }
 
 //
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// downloads can take far longer than an API call, so they use a client with only a connect timeout.
+// A file host that stops sending is caught by the idle timeout of each file instead.
+var downloadClient = httpClientWithTimeouts(5, 0)
+
+// errFileStalled is the cause of a file fetch cancelled because the host stopped sending
+var errFileStalled = errors.New("file host stopped sending")
+
+// idleReader cancels a fetch when the host sends nothing for the idle timeout
+type idleReader struct {
+	r     io.Reader
+	timer *time.Timer
+	idle  time.Duration
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	if n > 0 {
+		ir.timer.Reset(ir.idle)
+	}
+	return n, err
+}
+
+// stallError reports a fetch that failed because the host stalled as such, rather than as a cancel
+func stallError(ctx context.Context, err error) error {
+	if errors.Is(context.Cause(ctx), errFileStalled) {
+		return errFileStalled
+	}
+	return err
+}
+
+// errZipTooLarge is returned when a file would take a ZIP past the configured size cap
+var errZipTooLarge = errors.New("size limit reached")
+
+// errZipIncomplete is returned when a file fails after its entry was started, so the ZIP can not be finished
+var errZipIncomplete = errors.New("zip entry incomplete")
+
+// zipFile is a file to be added to a ZIP, with the size and checksum Archivematica recorded for it, if any
+type zipFile struct {
+	name         string
+	url          string
+	size         int64
+	checksum     string
+	checksumType string
+}
+
+// zipManifestEntry records the outcome of adding one file to a ZIP
+type zipManifestEntry struct {
+	name     string
+	checksum string
+	size     int64
+	err      error
+
+	// fixity is false if the file does not match the checksum Archivematica recorded
+	fixity bool
+}
+
+// fixityHash is the hash for a checksum type recorded by Archivematica, or nil if it is not supported
+func fixityHash(checksumType string) hash.Hash {
+	switch strings.ToLower(strings.ReplaceAll(checksumType, "-", "")) {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// unsafe characters are replaced in ZIP entry and file names
+var unsafeZipChars = regexp.MustCompile(`[/\\:*?"<>|\x00-\x1f]`)
+
+func zipName(name string) string {
+	name = unsafeZipChars.ReplaceAllString(name, "_")
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// zipManifestName is the name of the manifest added to the end of every ZIP
+const zipManifestName = "manifest-sha256.txt"
+
+// zipFiles lists the files below the selected nodes. A selected file is placed at the root of the ZIP
+// and a selected folder becomes a top level folder holding everything below it. Names that are
+// already taken, including the manifest's, are numbered like a~2.txt.
+func zipFiles(selected []*ArchivematicaS3Node) []zipFile {
+	files := make([]zipFile, 0)
+	used := map[string]bool{zipManifestName: true}
+	var add func(node *ArchivematicaS3Node, dir string)
+	add = func(node *ArchivematicaS3Node, dir string) {
+		name := path.Join(dir, zipName(node.Name))
+		if used[name] {
+			ext := path.Ext(name)
+			base := strings.TrimSuffix(name, ext)
+			for num := 2; used[name]; num++ {
+				name = fmt.Sprintf("%s~%d%s", base, num, ext)
+			}
+		}
+		used[name] = true
+		if len(node.Entries) == 0 {
+			if node.SourceURL != "" {
+				files = append(files, zipFile{name: name, url: node.SourceURL, size: node.Size, checksum: node.Checksum, checksumType: node.ChecksumType})
+			}
+			return
+		}
+		for idx := range node.Entries {
+			add(&node.Entries[idx], name)
+		}
+	}
+	for _, node := range selected {
+		add(node, "")
+	}
+	return files
+}
+
+// archivematicaDownloadHandler streams a ZIP of the files below one or more nodes, given as key
+// params. The ZIP is built as the files are fetched, so nothing is written to disk. It ends with a
+// manifest listing the SHA-256 of every file and any that fail their recorded fixity check.
+//
+// The recorded file sizes are checked against the size cap before anything is sent, so a selection
+// that is too big gets a 413. Files that can not be fetched, or whose size was not recorded and would
+// take the ZIP past the cap, are left out and listed in the manifest. A file that fails part way
+// through can not be left out, so the download is dropped rather than sending a corrupt ZIP.
+func archivematicaDownloadHandler(c *gin.Context) {
+	pid := c.Param("pid")
+	keys := c.QueryArray("key")
+	if len(keys) == 0 {
+		c.String(http.StatusBadRequest, "key is required")
+		return
+	}
+	ctx := c.Request.Context()
+	c.Set(viewTypeKey, "archivematica")
+	tree, err := getArchivematicaTree(ctx, pid)
+	if err != nil {
+		respondViewError(c, pid, err)
+		return
+	}
+
+	selected := make([]*ArchivematicaS3Node, 0, len(keys))
+	for _, key := range keys {
+		loc, ok := tree.find(key)
+		if !ok {
+			c.String(http.StatusNotFound, fmt.Sprintf("%s not found", key))
+			return
+		}
+		selected = append(selected, loc.node)
+	}
+	files := zipFiles(selected)
+	if len(files) == 0 {
+		c.String(http.StatusNotFound, "no downloadable files")
+		return
+	}
+	var planned int64
+	for _, file := range files {
+		planned += file.size
+	}
+	if planned > config.zipMaxBytes {
+		slog.InfoContext(ctx, "zip download too large", "pid", pid, "files", len(files), "bytes", planned, "max_bytes", config.zipMaxBytes)
+		c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("the selected files are %d bytes; downloads are limited to %d bytes", planned, config.zipMaxBytes))
+		return
+	}
+
+	fileName := zipName(pid)
+	if len(selected) == 1 {
+		fileName = zipName(selected[0].Name)
+	}
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, fileName))
+	c.Status(http.StatusOK)
+
+	slog.InfoContext(ctx, "zip download started", "pid", pid, "keys", len(keys), "files", len(files))
+	start := time.Now()
+	zw := zip.NewWriter(c.Writer)
+	manifest := make([]zipManifestEntry, 0, len(files))
+	var total int64
+	for _, file := range files {
+		entry := zipManifestEntry{name: file.name}
+		entry.size, entry.checksum, entry.fixity, entry.err = addZipFile(c, zw, file, config.zipMaxBytes-total)
+		if ctx.Err() != nil {
+			slog.InfoContext(ctx, "zip download abandoned", "pid", pid, "error", ctx.Err().Error())
+			return
+		}
+		if errors.Is(entry.err, errZipIncomplete) {
+			slog.ErrorContext(ctx, "zip download failed", "pid", pid, "file", file.name, "bytes", total, "error", entry.err.Error())
+			abortDownload(c)
+			return
+		}
+		total += entry.size
+		manifest = append(manifest, entry)
+	}
+	if err := writeZipManifest(zw, pid, manifest); err != nil {
+		slog.ErrorContext(ctx, "unable to write zip manifest", "pid", pid, "error", err.Error())
+	}
+	if err := zw.Close(); err != nil {
+		slog.ErrorContext(ctx, "unable to finish zip", "pid", pid, "error", err.Error())
+		return
+	}
+	slog.InfoContext(ctx, "zip download complete", "pid", pid, "files", len(files), "bytes", total,
+		"elapsed_ms", time.Since(start).Milliseconds())
+}
+
+// abortDownload drops the connection, so the client sees a failed download rather than a ZIP that
+// looks complete. Connections that can not be hijacked, like HTTP/2, are left with an unfinished ZIP
+// that has no central directory, which unzip tools reject.
+func abortDownload(c *gin.Context) {
+	c.Abort()
+	conn, _, err := c.Writer.Hijack()
+	if err != nil {
+		return
+	}
+	conn.Close()
+}
+
+// addZipFile fetches a file and copies it into the ZIP, returning its size, its SHA-256 and whether it
+// matches the checksum recorded by Archivematica. A file that can not be fetched, or that is known to
+// be bigger than the remaining allowance, is not added. Once the entry is started any failure is
+// errZipIncomplete, as the entry can not be taken back out of the ZIP.
+func addZipFile(c *gin.Context, zw *zip.Writer, file zipFile, remaining int64) (int64, string, bool, error) {
+	ctx := c.Request.Context()
+	idle := time.Duration(config.downloadIdleTimeout) * time.Second
+	fetchCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	timer := time.AfterFunc(idle, func() { cancel(errFileStalled) })
+	defer timer.Stop()
+
+	req, err := http.NewRequestWithContext(fetchCtx, http.MethodGet, file.url, nil)
+	if err != nil {
+		return 0, "", false, err
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		err = stallError(fetchCtx, err)
+		slog.ErrorContext(ctx, "unable to fetch file for zip", "url", file.url, "error", err.Error())
+		return 0, "", false, err
+	}
+	defer resp.Body.Close()
+	timer.Reset(idle)
+	body := &idleReader{r: resp.Body, timer: timer, idle: idle}
+	if resp.StatusCode != http.StatusOK {
+		slog.ErrorContext(ctx, "unable to fetch file for zip", "url", file.url, "status", resp.StatusCode)
+		return 0, "", false, fmt.Errorf("%s returned %d", file.url, resp.StatusCode)
+	}
+	if resp.ContentLength > remaining {
+		return 0, "", false, errZipTooLarge
+	}
+
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return 0, "", false, fmt.Errorf("%w: %s", errZipIncomplete, err.Error())
+	}
+	sum := sha256.New()
+	writers := []io.Writer{w, sum}
+	fixity := fixityHash(file.checksumType)
+	if file.checksum != "" && fixity != nil {
+		writers = append(writers, fixity)
+	}
+	// read one byte past the allowance so a file without a content length that is too big is caught
+	size, err := io.Copy(io.MultiWriter(writers...), io.LimitReader(body, remaining+1))
+	if err != nil {
+		return size, "", false, fmt.Errorf("%w: %s", errZipIncomplete, stallError(fetchCtx, err).Error())
+	}
+	if size > remaining {
+		return size, "", false, fmt.Errorf("%w: %w", errZipIncomplete, errZipTooLarge)
+	}
+	matches := true
+	if file.checksum != "" && fixity != nil {
+		matches = strings.EqualFold(hex.EncodeToString(fixity.Sum(nil)), file.checksum)
+		if !matches {
+			slog.WarnContext(ctx, "file does not match its recorded checksum", "url", file.url, "checksum_type", file.checksumType)
+		}
+	}
+	return size, hex.EncodeToString(sum.Sum(nil)), matches, nil
+}
+
+// writeZipManifest adds the manifest to the ZIP: the checksum and name of every file added, in the
+// sha256sum format, followed by any files that were left out
+func writeZipManifest(zw *zip.Writer, pid string, manifest []zipManifestEntry) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: zipManifestName, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	var out strings.Builder
+	missing := make([]zipManifestEntry, 0)
+	mismatched := make([]zipManifestEntry, 0)
+	for _, entry := range manifest {
+		if entry.err != nil {
+			missing = append(missing, entry)
+			continue
+		}
+		if !entry.fixity {
+			mismatched = append(mismatched, entry)
+		}
+		fmt.Fprintf(&out, "%s  %s\n", entry.checksum, entry.name)
+	}
+	if len(mismatched) > 0 {
+		fmt.Fprintf(&out, "\n# %d files do not match the checksum recorded by Archivematica:\n", len(mismatched))
+		for _, entry := range mismatched {
+			fmt.Fprintf(&out, "# %s\n", entry.name)
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(&out, "\n# %d files of %s were not included:\n", len(missing), pid)
+		for _, entry := range missing {
+			reason := entry.err.Error()
+			if errors.Is(entry.err, errZipTooLarge) {
+				reason = fmt.Sprintf("the download is limited to %d bytes", config.zipMaxBytes)
+			}
+			fmt.Fprintf(&out, "# %s: %s\n", entry.name, reason)
+		}
+	}
+	_, err = io.WriteString(w, out.String())
+	return err
+}
+
+//
+// end of file
+//
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchivematicaDownload(t *testing.T) {
+	const helloSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	tests := []struct {
+		name     string
+		maxBytes int64
+		entries  string
+		status   int
+		files    []string
+		manifest []string
+		dropped  bool
+	}{
+		{
+			name:     "complete",
+			maxBytes: 1 << 20,
+			entries: `{"name": "hello.txt", "type": "file", "source_url": "%[1]s/files/hello.txt", "size": 5,
+				"checksum": "` + helloSHA256 + `", "checksum_type": "sha256"}`,
+			status:   http.StatusOK,
+			files:    []string{"t/hello.txt", "manifest-sha256.txt"},
+			manifest: []string{helloSHA256 + "  t/hello.txt"},
+		},
+		{
+			name:     "missing file",
+			maxBytes: 1 << 20,
+			entries: `{"name": "hello.txt", "type": "file", "source_url": "%[1]s/files/hello.txt", "size": 5},
+				{"name": "gone.txt", "type": "file", "source_url": "%[1]s/files/gone.txt", "size": 5}`,
+			status:   http.StatusOK,
+			files:    []string{"t/hello.txt", "manifest-sha256.txt"},
+			manifest: []string{"# 1 files of am:1 were not included:", "# t/gone.txt: "},
+		},
+		{
+			name:     "too large",
+			maxBytes: 8,
+			entries: `{"name": "hello.txt", "type": "file", "source_url": "%[1]s/files/hello.txt", "size": 5},
+				{"name": "again.txt", "type": "file", "source_url": "%[1]s/files/hello.txt", "size": 5}`,
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:     "unknown size over the limit",
+			maxBytes: 100,
+			entries: `{"name": "hello.txt", "type": "file", "source_url": "%[1]s/files/hello.txt", "size": 5},
+				{"name": "big.bin", "type": "file", "source_url": "%[1]s/files/big.bin"}`,
+			dropped: true,
+		},
+		{
+			name:     "file host does not respond",
+			maxBytes: 1 << 20,
+			entries: `{"name": "hello.txt", "type": "file", "source_url": "%[1]s/files/hello.txt", "size": 5},
+				{"name": "slow.txt", "type": "file", "source_url": "%[1]s/files/slow.txt", "size": 5}`,
+			status:   http.StatusOK,
+			files:    []string{"t/hello.txt", "manifest-sha256.txt"},
+			manifest: []string{"# t/slow.txt: file host stopped sending"},
+		},
+		{
+			name:     "file host stalls part way",
+			maxBytes: 1 << 20,
+			entries: `{"name": "hello.txt", "type": "file", "source_url": "%[1]s/files/hello.txt", "size": 5},
+				{"name": "stalled.bin", "type": "file", "source_url": "%[1]s/files/stalled.bin", "size": 200}`,
+			dropped: true,
+		},
+		{
+			name:     "broken file",
+			maxBytes: 1 << 20,
+			entries: `{"name": "hello.txt", "type": "file", "source_url": "%[1]s/files/hello.txt", "size": 5},
+				{"name": "broken.bin", "type": "file", "source_url": "%[1]s/files/broken.bin", "size": 200}`,
+			dropped: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			config.zipMaxBytes = tt.maxBytes
+			env.backend.HandleText("/files/hello.txt", "hello")
+			env.backend.HandleStreamed("/files/big.bin", bytes.Repeat([]byte("x"), 200), false)
+			env.backend.HandleStreamed("/files/broken.bin", bytes.Repeat([]byte("x"), 200), true)
+			env.backend.HandleStalled("/files/stalled.bin", bytes.Repeat([]byte("x"), 200))
+			env.backend.HandleSlow("/files/slow.txt", 5*time.Second, "hello")
+			entries := fmt.Sprintf(tt.entries, env.backend.URL())
+			env.addTree("am:1", `{"name": "t", "type": "folder", "entries": [`+entries+`]}`)
+
+			// a real server, so a dropped connection can be seen
+			server := httptest.NewServer(env.router)
+			defer server.Close()
+			resp, err := http.Get(server.URL + "/api/view/am:1/archivematica/download?key=" + nodeKey("/t"))
+			var body []byte
+			if err == nil {
+				defer resp.Body.Close()
+				body, err = io.ReadAll(resp.Body)
+			}
+			if tt.dropped {
+				if err == nil {
+					t.Fatalf("download of %d bytes succeeded; want a dropped connection", len(body))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("download failed: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+			if err != nil {
+				t.Fatalf("download is not a ZIP: %v", err)
+			}
+			names := make([]string, 0)
+			manifest := ""
+			for _, f := range zr.File {
+				names = append(names, f.Name)
+				if f.Name == "manifest-sha256.txt" {
+					rc, _ := f.Open()
+					data, _ := io.ReadAll(rc)
+					rc.Close()
+					manifest = string(data)
+				}
+			}
+			if strings.Join(names, ",") != strings.Join(tt.files, ",") {
+				t.Errorf("ZIP holds %v, want %v", names, tt.files)
+			}
+			for _, line := range tt.manifest {
+				if !strings.Contains(manifest, line) {
+					t.Errorf("manifest is missing %q:\n%s", line, manifest)
+				}
+			}
+		})
+	}
+}
+
+func TestZipFileNamesAreUnique(t *testing.T) {
+	file := func(name string) ArchivematicaS3Node {
+		return ArchivematicaS3Node{Name: name, Type: "file", SourceURL: "https://files.example.org/" + name}
+	}
+	tests := []struct {
+		name     string
+		selected []ArchivematicaS3Node
+		want     []string
+	}{
+		{
+			name:     "numbered name",
+			selected: []ArchivematicaS3Node{{Name: "t", Type: "folder", Entries: []ArchivematicaS3Node{file("a.txt"), file("a.txt"), file("a~2.txt")}}},
+			want:     []string{"t/a.txt", "t/a~2.txt", "t/a~2~2.txt"},
+		},
+		{
+			name:     "numbered first",
+			selected: []ArchivematicaS3Node{{Name: "t", Type: "folder", Entries: []ArchivematicaS3Node{file("a~2.txt"), file("a.txt"), file("a.txt")}}},
+			want:     []string{"t/a~2.txt", "t/a.txt", "t/a~3.txt"},
+		},
+		{
+			name:     "manifest",
+			selected: []ArchivematicaS3Node{file("manifest-sha256.txt")},
+			want:     []string{"manifest-sha256~2.txt"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selected := make([]*ArchivematicaS3Node, 0)
+			for idx := range tt.selected {
+				selected = append(selected, &tt.selected[idx])
+			}
+			names := make([]string, 0)
+			for _, f := range zipFiles(selected) {
+				names = append(names, f.name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("zip names = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fakeResponse is a canned response served by a fakeBackend
+type fakeResponse struct {
+	status      int
+	contentType string
+	body        []byte
+
+	// delay holds the response back, unless the client gives up first
+	delay time.Duration
+
+	// streamed responses are sent without a content length; broken ones drop the connection half way
+	// and stalled ones stop sending half way until the client gives up
+	streamed bool
+	broken   bool
+	stalled  bool
+}
+
+// fakeBackend is a local HTTP server that stands in for iiifman, Apollo, the rights service and WSLS.
+// Responses are registered by path; anything unregistered is a 404.
+type fakeBackend struct {
+	lock      sync.RWMutex
+	responses map[string]fakeResponse
+	requests  map[string]int
+	server    *httptest.Server
+
+	// abandoned counts the slow responses the client gave up on before they were sent
+	abandoned atomic.Int32
+}
+
+func newFakeBackend() *fakeBackend {
+	fb := &fakeBackend{responses: make(map[string]fakeResponse), requests: make(map[string]int)}
+	fb.server = httptest.NewServer(http.HandlerFunc(fb.serveHTTP))
+	return fb
+}
+
+// URL is the base URL of the fake server
+func (fb *fakeBackend) URL() string {
+	return fb.server.URL
+}
+
+// Close shuts down the fake server
+func (fb *fakeBackend) Close() {
+	fb.server.Close()
+}
+
+// Requests is the number of requests made for a path
+func (fb *fakeBackend) Requests(path string) int {
+	fb.lock.RLock()
+	defer fb.lock.RUnlock()
+	return fb.requests[path]
+}
+
+// Handle registers the response for a path
+func (fb *fakeBackend) Handle(path string, status int, contentType string, body []byte) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	fb.responses[path] = fakeResponse{status: status, contentType: contentType, body: body}
+}
+
+// HandleJSON registers a successful JSON response for a path
+func (fb *fakeBackend) HandleJSON(path string, body string) {
+	fb.Handle(path, http.StatusOK, "application/json", []byte(body))
+}
+
+// HandleText registers a successful plain text response for a path
+func (fb *fakeBackend) HandleText(path string, body string) {
+	fb.Handle(path, http.StatusOK, "text/plain", []byte(body))
+}
+
+// HandleSlow registers a successful JSON response for a path that is sent after a delay
+func (fb *fakeBackend) HandleSlow(path string, delay time.Duration, body string) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	fb.responses[path] = fakeResponse{status: http.StatusOK, contentType: "application/json", body: []byte(body), delay: delay}
+}
+
+// HandleStalled registers a file for a path that stops being sent half way through
+func (fb *fakeBackend) HandleStalled(path string, body []byte) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	fb.responses[path] = fakeResponse{status: http.StatusOK, contentType: "application/octet-stream", body: body, streamed: true, stalled: true}
+}
+
+// HandleStreamed registers a file for a path that is sent without a content length. A broken file
+// stops half way through.
+func (fb *fakeBackend) HandleStreamed(path string, body []byte, broken bool) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	fb.responses[path] = fakeResponse{status: http.StatusOK, contentType: "application/octet-stream", body: body, streamed: true, broken: broken}
+}
+
+func (fb *fakeBackend) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	fb.lock.Lock()
+	resp, ok := fb.responses[r.URL.Path]
+	fb.requests[r.URL.Path]++
+	fb.lock.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if resp.delay > 0 {
+		select {
+		case <-time.After(resp.delay):
+		case <-r.Context().Done():
+			fb.abandoned.Add(1)
+			return
+		}
+	}
+	if resp.contentType != "" {
+		w.Header().Set("Content-Type", resp.contentType)
+	}
+	w.WriteHeader(resp.status)
+	if !resp.streamed {
+		w.Write(resp.body)
+		return
+	}
+
+	half := len(resp.body) / 2
+	w.Write(resp.body[:half])
+	w.(http.Flusher).Flush()
+	if resp.broken {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+		return
+	}
+	if resp.stalled {
+		<-r.Context().Done()
+		return
+	}
+	w.Write(resp.body[half:])
+}
+
+// useFakes points every backend at a fake: iiifman, Apollo, rights and WSLS are all served by the
+// fake HTTP backend under /iiif, /apollo, /rights and /wsls, and the Archivematica store by an in-memory one.
+// Caches are reset so nothing resolved against the real services is reused.
+func useFakes(fb *fakeBackend, objects *memoryObjectStore) {
+	base := strings.TrimSuffix(fb.URL(), "/")
+	config.iiifURL = base + "/iiif"
+	config.apolloURL = base + "/apollo"
+	config.rightsURL = base + "/rights"
+	config.wslsURL = base + "/wsls"
+	store = objects
+	initPIDCache()
+	initResponseCache()
+	initTreeCache()
+}
+
+// memoryObjectStore keeps objects in memory. It stands in for the Archivematica store in tests.
+type memoryObjectStore struct {
+	lock    sync.RWMutex
+	objects map[string][]byte
+}
+
+func newMemoryObjectStore() *memoryObjectStore {
+	return &memoryObjectStore{objects: make(map[string][]byte)}
+}
+
+func (m *memoryObjectStore) Name() string {
+	return "memory"
+}
+
+// Put adds or replaces an object
+func (m *memoryObjectStore) Put(key string, data []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.objects[key] = data
+}
+
+func (m *memoryObjectStore) URL(key string) string {
+	return "memory:///" + key
+}
+
+func (m *memoryObjectStore) GetObject(ctx context.Context, key string) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	data, ok := m.objects[key]
+	if !ok {
+		return nil, &UpstreamError{Backend: storageBackend.name, URL: m.URL(key),
+			StatusCode: http.StatusNotFound, Err: errors.New("no such key")}
+	}
+	return data, nil
+}
+
+func (m *memoryObjectStore) List(ctx context.Context) ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	keys := make([]string, 0, len(m.objects))
+	for key := range m.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *memoryObjectStore) Check(ctx context.Context) error {
+	return nil
+}
+
+//
+// end of file
+//
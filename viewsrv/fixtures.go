@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Fixture mode lets Curio run without any upstream services. In record mode every successful
+// response from iiifman, Apollo and the Archivematica store is saved below the fixture directory as it is received. In
+// replay mode those files are served instead of calling the services; anything that was not recorded
+// is treated as not found. Files are laid out as:
+//
+//	http/<host>/<path>.fixture    responses from HTTP backends
+//	s3/<bucket>/<key>.fixture     Archivematica objects (file/<dir>/<key>.fixture for a local store)
+const fixtureSuffix = ".fixture"
+
+const (
+	fixturesOff    = "off"
+	fixturesRecord = "record"
+	fixturesReplay = "replay"
+)
+
+// initFixtures wraps the HTTP client and object store according to the fixture mode
+func initFixtures() {
+	switch config.fixtureMode {
+	case "", fixturesOff:
+		return
+	case fixturesRecord:
+		httpClient.Transport = &fixtureTransport{dir: config.fixtureDir, next: httpClient.Transport}
+		store = &fixtureObjectStore{dir: config.fixtureDir, location: storeLocation(), next: store}
+	case fixturesReplay:
+		httpClient.Transport = &fixtureTransport{dir: config.fixtureDir}
+		store = &fixtureObjectStore{dir: config.fixtureDir, location: storeLocation()}
+	default:
+		fatal("unsupported fixture mode", "mode", config.fixtureMode)
+	}
+	slog.Info("fixture mode enabled", "mode", config.fixtureMode, "dir", config.fixtureDir)
+}
+
+// replayingFixtures is true when no upstream service is ever called
+func replayingFixtures() bool {
+	return config.fixtureMode == fixturesReplay
+}
+
+// fixtureFile is the file holding a fixture. The path is cleaned so it can not escape the fixture directory.
+func fixtureFile(dir string, kind string, parts ...string) string {
+	rel := filepath.Clean("/" + filepath.Join(parts...))
+	return filepath.Join(dir, kind, rel) + fixtureSuffix
+}
+
+func httpFixtureFile(dir string, u *url.URL) string {
+	path := u.Path
+	if u.RawQuery != "" {
+		path += "_" + url.QueryEscape(u.RawQuery)
+	}
+	return fixtureFile(dir, "http", u.Host, path)
+}
+
+// objectFixtureDir is the directory holding the objects from a store; the store location is part of
+// the path, so an object in s3://bucket/prefix is saved as s3/bucket/prefix/<key>.fixture
+func objectFixtureDir(dir string, location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return filepath.Join(dir, "objects")
+	}
+	return filepath.Join(dir, u.Scheme, filepath.Clean("/"+filepath.Join(u.Host, u.Path)))
+}
+
+func objectFixtureFile(dir string, location string, key string) string {
+	return fixtureFile(objectFixtureDir(dir, location), "", key)
+}
+
+func writeFixture(ctx context.Context, file string, data []byte) {
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(file, data, 0644)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to record fixture", "file", file, "error", err.Error())
+		return
+	}
+	slog.InfoContext(ctx, "recorded fixture", "file", file)
+}
+
+// fixtureTransport serves HTTP requests from recorded fixtures. When it has a next transport it
+// records instead: requests are passed on and successful responses saved.
+type fixtureTransport struct {
+	dir  string
+	next http.RoundTripper
+}
+
+func (ft *fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	file := httpFixtureFile(ft.dir, req.URL)
+	if ft.next != nil {
+		resp, err := ft.next.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return resp, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		writeFixture(req.Context(), file, body)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return resp, nil
+	}
+
+	status := http.StatusOK
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		status = http.StatusNotFound
+		body = []byte(fmt.Sprintf("no fixture for %s", req.URL.String()))
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// fixtureObjectStore serves objects from recorded fixtures. When it has a next store it records
+// instead: objects are read from that store and saved.
+type fixtureObjectStore struct {
+	dir      string
+	location string
+	next     objectStore
+}
+
+func (fs *fixtureObjectStore) Name() string {
+	if fs.next != nil {
+		return fs.next.Name() + "+record"
+	}
+	return "fixtures"
+}
+
+func (fs *fixtureObjectStore) URL(key string) string {
+	if fs.next != nil {
+		return fs.next.URL(key)
+	}
+	return strings.TrimSuffix(fs.location, "/") + "/" + key
+}
+
+func (fs *fixtureObjectStore) GetObject(ctx context.Context, key string) ([]byte, error) {
+	file := objectFixtureFile(fs.dir, fs.location, key)
+	if fs.next != nil {
+		data, err := fs.next.GetObject(ctx, key)
+		if err == nil {
+			writeFixture(ctx, file, data)
+		}
+		return data, err
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		upErr := &UpstreamError{Backend: storageBackend.name, URL: fs.URL(key), Err: err}
+		if errors.Is(err, os.ErrNotExist) {
+			upErr.StatusCode = http.StatusNotFound
+		}
+		return nil, upErr
+	}
+	return data, nil
+}
+
+func (fs *fixtureObjectStore) List(ctx context.Context) ([]string, error) {
+	if fs.next != nil {
+		return fs.next.List(ctx)
+	}
+	return listFiles(objectFixtureDir(fs.dir, fs.location), fixtureSuffix)
+}
+
+func (fs *fixtureObjectStore) Check(ctx context.Context) error {
+	if fs.next != nil {
+		return fs.next.Check(ctx)
+	}
+	return nil
+}
+
+//
+// end of file
+//
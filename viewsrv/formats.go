@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+)
+
+// the kinds of preview the viewer can show for a file
+const (
+	previewImage = "image"
+	previewPDF   = "pdf"
+	previewAudio = "audio"
+	previewVideo = "video"
+	previewText  = "text"
+	previewNone  = "none"
+)
+
+// fileFormat is how the viewer presents a file format
+type fileFormat struct {
+	Preview string
+	Icon    string
+}
+
+// formats by PRONOM ID. These take priority as they are more precise than MIME types.
+var formatsByPUID = map[string]fileFormat{
+	"fmt/14":    {previewPDF, "fa fa-file-pdf"},
+	"fmt/15":    {previewPDF, "fa fa-file-pdf"},
+	"fmt/16":    {previewPDF, "fa fa-file-pdf"},
+	"fmt/17":    {previewPDF, "fa fa-file-pdf"},
+	"fmt/18":    {previewPDF, "fa fa-file-pdf"},
+	"fmt/19":    {previewPDF, "fa fa-file-pdf"},
+	"fmt/20":    {previewPDF, "fa fa-file-pdf"},
+	"fmt/276":   {previewPDF, "fa fa-file-pdf"},
+	"fmt/95":    {previewPDF, "fa fa-file-pdf"},
+	"fmt/354":   {previewPDF, "fa fa-file-pdf"},
+	"fmt/476":   {previewPDF, "fa fa-file-pdf"},
+	"fmt/477":   {previewPDF, "fa fa-file-pdf"},
+	"fmt/478":   {previewPDF, "fa fa-file-pdf"},
+	"fmt/43":    {previewImage, "fa fa-file-image"},
+	"fmt/44":    {previewImage, "fa fa-file-image"},
+	"fmt/11":    {previewImage, "fa fa-file-image"},
+	"fmt/12":    {previewImage, "fa fa-file-image"},
+	"fmt/13":    {previewImage, "fa fa-file-image"},
+	"fmt/3":     {previewImage, "fa fa-file-image"},
+	"fmt/4":     {previewImage, "fa fa-file-image"},
+	"fmt/353":   {previewNone, "fa fa-file-image"},
+	"fmt/134":   {previewAudio, "fa fa-file-audio"},
+	"fmt/141":   {previewAudio, "fa fa-file-audio"},
+	"fmt/1":     {previewAudio, "fa fa-file-audio"},
+	"fmt/2":     {previewAudio, "fa fa-file-audio"},
+	"fmt/6":     {previewAudio, "fa fa-file-audio"},
+	"fmt/199":   {previewVideo, "fa fa-file-video"},
+	"fmt/573":   {previewVideo, "fa fa-file-video"},
+	"x-fmt/111": {previewText, "fa fa-file-alt"},
+	"x-fmt/18":  {previewText, "fa fa-file-csv"},
+	"fmt/817":   {previewText, "fa fa-file-code"},
+	"fmt/101":   {previewText, "fa fa-file-code"},
+	"fmt/40":    {previewNone, "fa fa-file-word"},
+	"fmt/412":   {previewNone, "fa fa-file-word"},
+	"fmt/61":    {previewNone, "fa fa-file-excel"},
+	"fmt/214":   {previewNone, "fa fa-file-excel"},
+	"x-fmt/263": {previewNone, "fa fa-file-archive"},
+}
+
+// formats by exact MIME type
+var formatsByMIME = map[string]fileFormat{
+	"application/pdf":    {previewPDF, "fa fa-file-pdf"},
+	"application/json":   {previewText, "fa fa-file-code"},
+	"application/xml":    {previewText, "fa fa-file-code"},
+	"text/xml":           {previewText, "fa fa-file-code"},
+	"text/csv":           {previewText, "fa fa-file-csv"},
+	"text/plain":         {previewText, "fa fa-file-alt"},
+	"image/tiff":         {previewNone, "fa fa-file-image"},
+	"application/msword": {previewNone, "fa fa-file-word"},
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": {previewNone, "fa fa-file-word"},
+	"application/vnd.ms-excel": {previewNone, "fa fa-file-excel"},
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": {previewNone, "fa fa-file-excel"},
+	"application/zip": {previewNone, "fa fa-file-archive"},
+}
+
+// formats by the type part of a MIME type, used when the full type is not known
+var formatsByMIMEType = map[string]fileFormat{
+	"image": {previewImage, "fa fa-file-image"},
+	"audio": {previewAudio, "fa fa-file-audio"},
+	"video": {previewVideo, "fa fa-file-video"},
+	"text":  {previewText, "fa fa-file-alt"},
+}
+
+// lookupFormat finds how to present a file. A tree that marks a file with view "image" has always
+// had it shown as an image, so that wins; otherwise it goes by PRONOM ID, then MIME type, then the
+// older format name hint in the tree.
+func lookupFormat(node ArchivematicaS3Node) fileFormat {
+	if node.View == "image" {
+		return fileFormat{previewImage, "fa fa-file-image"}
+	}
+	if format, ok := formatsByPUID[strings.TrimSpace(node.PUID)]; ok {
+		return format
+	}
+	mimeType := primaryMIMEType(node.MimeType)
+	if format, ok := formatsByMIME[mimeType]; ok {
+		return format
+	}
+	if format, ok := formatsByMIMEType[strings.SplitN(mimeType, "/", 2)[0]]; ok {
+		return format
+	}
+	switch {
+	case strings.Contains(node.Format, "PDF"):
+		return fileFormat{previewPDF, "fa fa-file-pdf"}
+	case strings.Contains(node.Format, "Word"):
+		return fileFormat{previewNone, "fa fa-file-word"}
+	case strings.Contains(node.Format, "Excel"):
+		return fileFormat{previewNone, "fa fa-file-excel"}
+	}
+	return fileFormat{previewNone, "fa fa-file"}
+}
+
+// primaryMIMEType is the first of the MIME types recorded for a file, without any parameters
+func primaryMIMEType(mimeTypes string) string {
+	first := strings.FieldsFunc(mimeTypes, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(first) == 0 {
+		return ""
+	}
+	return strings.ToLower(strings.SplitN(first[0], ";", 2)[0])
+}
+
+//
+// end of file
+//
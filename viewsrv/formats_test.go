@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestLookupFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		node    ArchivematicaS3Node
+		preview string
+		icon    string
+	}{
+		{"pronom id", ArchivematicaS3Node{PUID: "fmt/14", MimeType: "text/plain"}, previewPDF, "fa fa-file-pdf"},
+		{"mime type", ArchivematicaS3Node{MimeType: "text/csv"}, previewText, "fa fa-file-csv"},
+		{"mime type part", ArchivematicaS3Node{MimeType: "video/x-matroska"}, previewVideo, "fa fa-file-video"},
+		{"tiff", ArchivematicaS3Node{PUID: "fmt/353", MimeType: "image/tiff"}, previewNone, "fa fa-file-image"},
+		{"tiff marked as an image", ArchivematicaS3Node{PUID: "fmt/353", MimeType: "image/tiff", View: "image"}, previewImage, "fa fa-file-image"},
+		{"format name", ArchivematicaS3Node{Format: "Microsoft Word Document"}, previewNone, "fa fa-file-word"},
+		{"unknown", ArchivematicaS3Node{}, previewNone, "fa fa-file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format := lookupFormat(tt.node)
+			if format.Preview != tt.preview || format.Icon != tt.icon {
+				t.Errorf("lookupFormat = %+v, want {%s %s}", format, tt.preview, tt.icon)
+			}
+		})
+	}
+}
+
+func TestImageViewKeepsImageType(t *testing.T) {
+	node := transformNode(ArchivematicaS3Node{Name: "scan.tif", Type: "file", PUID: "fmt/353", MimeType: "image/tiff", View: "image"}, "", 0, 1)
+	if node.Data.Type != "image" {
+		t.Errorf("type = %q, want image", node.Data.Type)
+	}
+}
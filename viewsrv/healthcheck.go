@@ -2,46 +2,190 @@ package main
 
 // Check health of service
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/gin-gonic/gin"
-	"log"
+	"log/slog"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
+// healthcheck is the reported status of a single dependency
+type healthcheck struct {
+	Healthy  bool           `json:"healthy"`
+	Critical bool           `json:"critical"`
+	Latency  int64          `json:"latency_ms"`
+	Message  string         `json:"message,omitempty"`
+	Circuit  *circuitStatus `json:"circuit,omitempty"`
+}
+
+// dependency is something Curio needs to be able to reach. Critical dependencies are on the core
+// view path; if one fails the node is reported as unhealthy. Others only degrade the service.
+type dependency struct {
+	name    string
+	backend *upstream
+	check   func(ctx context.Context) error
+}
+
+func dependencies() []dependency {
+	return []dependency{
+		{name: "iiifmanifest", backend: iiifBackend, check: func(ctx context.Context) error {
+			_, err := fetchAPIResponseOnce(ctx, iiifBackend, fmt.Sprintf("%s/version", config.iiifURL))
+			return err
+		}},
+		{name: "apollo", backend: apolloBackend, check: func(ctx context.Context) error {
+			return checkReachable(ctx, apolloBackend, config.apolloURL)
+		}},
+		{name: "rights", backend: rightsBackend, check: func(ctx context.Context) error {
+			return checkReachable(ctx, rightsBackend, config.rightsURL)
+		}},
+		{name: "wsls", backend: wslsBackend, check: func(ctx context.Context) error {
+			return checkReachable(ctx, wslsBackend, config.wslsURL)
+		}},
+		{name: "archivematica", backend: storageBackend, check: func(ctx context.Context) error {
+			return store.Check(ctx)
+		}},
+	}
+}
+
+// healthCheckHandler checks every dependency concurrently, each with its own timeout. It fails only
+// if a critical dependency is unhealthy.
 func healthCheckHandler(c *gin.Context) {
+	results := checkDependencies(c.Request.Context(), dependencies())
 
-	type healthcheck struct {
-		Healthy bool   `json:"healthy"`
-		Message string `json:"message"`
+	httpStatus := http.StatusOK
+	for name, status := range results {
+		if status.Healthy {
+			continue
+		}
+		if status.Critical {
+			slog.ErrorContext(c.Request.Context(), "critical dependency is unhealthy", "dependency", name, "error", status.Message)
+			httpStatus = http.StatusInternalServerError
+		} else {
+			slog.WarnContext(c.Request.Context(), "dependency is unhealthy", "dependency", name, "error", status.Message)
+		}
+	}
+
+	c.JSON(httpStatus, results)
+}
+
+// isCritical is true for dependencies that are on the core view path
+func isCritical(name string) bool {
+	for _, critical := range splitList(config.criticalDeps) {
+		if critical == name {
+			return true
+		}
 	}
+	return false
+}
 
-	//log.Printf("INFO: checking Tracksys...")
-	//url := fmt.Sprintf("%s/pid/uva-lib:1157560/type", config.tracksysURL)
+// checkDependencies runs the checks for a list of dependencies concurrently
+func checkDependencies(ctx context.Context, deps []dependency) map[string]healthcheck {
+	results := make(map[string]healthcheck)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, dep := range deps {
+		wg.Add(1)
+		go func(dep dependency) {
+			defer wg.Done()
+			status := checkDependency(ctx, dep)
+			lock.Lock()
+			results[dep.name] = status
+			lock.Unlock()
+		}(dep)
+	}
+	wg.Wait()
+	return results
+}
 
-	//tsStatus := healthcheck{true, ""}
-	//_, err := getAPIResponse(url)
-	//if err != nil {
-	//	tsStatus.Healthy = false
-	//	tsStatus.Message = err.Error()
-	//}
+func checkDependency(ctx context.Context, dep dependency) healthcheck {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.healthTimeout)*time.Second)
+	defer cancel()
+
+	if replayingFixtures() {
+		return healthcheck{Healthy: true, Critical: isCritical(dep.name), Message: "replaying fixtures"}
+	}
 
-	// make sure IIIF manifest service is alive
-	log.Printf("INFO: checking IIIF...")
-	url := fmt.Sprintf("%s/version", config.iiifURL)
-	iiifStatus := healthcheck{true, ""}
+	start := time.Now()
+	err := dep.check(ctx)
+	status := healthcheck{Healthy: err == nil, Critical: isCritical(dep.name), Latency: time.Since(start).Milliseconds()}
+	if err != nil {
+		status.Message = err.Error()
+	}
+	if dep.backend.breaker != nil {
+		circuit := dep.backend.breaker.status()
+		status.Circuit = &circuit
+	}
+	return status
+}
 
-	_, err := getAPIResponse(url)
+// checkReachable succeeds if the URL responds with anything other than a server error
+func checkReachable(ctx context.Context, backend *upstream, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return &UpstreamError{Backend: backend.name, URL: url, Err: err}
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		iiifStatus.Healthy = false
-		iiifStatus.Message = err.Error()
+		return &UpstreamError{Backend: backend.name, URL: url, Err: err}
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return &UpstreamError{Backend: backend.name, URL: url, StatusCode: resp.StatusCode, Err: errors.New(http.StatusText(resp.StatusCode))}
 	}
+	return nil
+}
 
-	httpStatus := http.StatusOK
-	//	if tsStatus.Healthy == false || iiifStatus.Healthy == false {
-	if iiifStatus.Healthy == false {
-		httpStatus = http.StatusInternalServerError
+// ready is true once startup has completed, and false again once shutdown has started
+var ready atomic.Bool
+
+func setReady(isReady bool) {
+	slog.Info("readiness changed", "ready", isReady)
+	ready.Store(isReady)
+}
+
+// livenessHandler reports that the process is up and able to serve requests. It never checks
+// dependencies so a slow backend can not get a healthy process killed.
+func livenessHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"alive": true})
+}
+
+// readinessHandler reports whether this node should be sent traffic: startup is complete, it is not
+// shutting down, templates and the object store are initialized and the critical dependencies are reachable
+func readinessHandler(c *gin.Context) {
+	problems := make([]string, 0)
+	if !ready.Load() {
+		problems = append(problems, "not started or shutting down")
+	}
+	if !templatesLoaded() {
+		problems = append(problems, "embed templates not loaded")
+	}
+	if store == nil {
+		problems = append(problems, "object store not initialized")
 	}
 
-	//	c.JSON(httpStatus, gin.H{"tracksys": tsStatus, "iiifmanifest": iiifStatus})
-	c.JSON(httpStatus, gin.H{"iiifmanifest": iiifStatus})
+	critical := make([]dependency, 0)
+	for _, dep := range dependencies() {
+		if isCritical(dep.name) {
+			critical = append(critical, dep)
+		}
+	}
+	results := checkDependencies(c.Request.Context(), critical)
+	for name, status := range results {
+		if !status.Healthy {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, status.Message))
+		}
+	}
+
+	if len(problems) > 0 {
+		slog.WarnContext(c.Request.Context(), "not ready", "problems", strings.Join(problems, "; "))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"ready": false, "problems": problems, "dependencies": results})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ready": true, "dependencies": results})
 }
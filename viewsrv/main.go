@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/contrib/static"
@@ -17,23 +23,91 @@ const Version = "6.3.3"
 
 func main() {
 	// Load cfg
-	log.Printf("===> Curio is staring up <===")
 	getConfiguration()
-	initS3()
+
+	// curio [flags] validate checks every Archivematica tree and exits
+	if flag.Arg(0) == "validate" {
+		initStore()
+		initFixtures()
+		os.Exit(validateTrees(context.Background()))
+	}
+
+	slog.Info("===> Curio is starting up <===", "version", Version)
+	shutdownTracing := initTracing()
+	initUpstreams()
+	initStore()
+	initFixtures()
+	initResolvers()
+	initPIDCache()
+	initResponseCache()
+	initTreeCache()
+	if err := loadTemplates(); err != nil {
+		slog.Error("unable to load embed templates", "error", err.Error())
+	}
 
 	// Set routes and start server
 	gin.SetMode(gin.ReleaseMode)
 	gin.DisableConsoleColor()
-	router := gin.Default()
+	router := newRouter()
 
-	// Set routes and start server
+	portStr := fmt.Sprintf(":%d", config.port)
+	server := &http.Server{Addr: portStr, Handler: router}
+	go func() {
+		slog.Info("start Curio with CORS support enabled", "port", portStr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatal("server failed", "error", err.Error())
+		}
+	}()
+	setReady(true)
+
+	// wait for a request to stop, then stop taking new traffic and let in-flight requests finish
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-stop
+	slog.Info("shutting down", "signal", sig.String())
+	setReady(false)
+
+	// keep serving while load balancers notice /readyz failing and stop sending new requests
+	if config.shutdownDelay > 0 {
+		slog.Info("draining before shutdown", "delay_sec", config.shutdownDelay)
+		time.Sleep(time.Duration(config.shutdownDelay) * time.Second)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.shutdownTimeout)*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("in-flight requests did not finish in time", "timeout_sec", config.shutdownTimeout, "error", err.Error())
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("unable to flush traces", "error", err.Error())
+	}
+	slog.Info("Curio shutdown complete")
+}
+
+// newRouter creates the router with every middleware and route
+func newRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(requestIDMiddleware(), requestLogger(), gin.Recovery())
 	router.Use(cors.Default())
+	router.Use(metricsMiddleware())
 	router.GET("/version", versionHandler)
+	router.GET("/metrics", metricsHandler)
 	router.GET("/healthcheck", healthCheckHandler)
-	router.GET("/oembed", oEmbedHandler)
-	api := router.Group("/api")
+	router.GET("/healthz", livenessHandler)
+	router.GET("/readyz", readinessHandler)
+	router.GET("/oembed", tracingMiddleware(), oEmbedHandler)
+	api := router.Group("/api", tracingMiddleware())
 	{
 		api.GET("/view/:pid", viewHandler)
+		api.GET("/view/:pid/archivematica/node/:key", archivematicaNodeHandler)
+		api.GET("/view/:pid/archivematica/search", archivematicaSearchHandler)
+		api.GET("/view/:pid/archivematica/download", archivematicaDownloadHandler)
+		api.GET("/view/:pid/archivematica/preview/:key", archivematicaPreviewHandler)
+		api.GET("/config", configHandler)
+	}
+	admin := api.Group("/admin", requireAdmin())
+	{
+		admin.DELETE("/cache/:pid", purgeCacheHandler)
 	}
 
 	// Note: in dev mode, this is never actually used. The front end is served
@@ -46,10 +120,7 @@ func main() {
 	router.NoRoute(func(c *gin.Context) {
 		c.File("./public/index.html")
 	})
-
-	portStr := fmt.Sprintf(":%d", config.port)
-	log.Printf("INFO: start Curio on port %s with CORS support enabled", portStr)
-	log.Fatal(router.Run(portStr))
+	return router
 }
 
 // Handle a request for / and return version info
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// viewTypeKey is the gin context key handlers use to record the type of view they resolved
+const viewTypeKey = "viewType"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "curio_http_requests_total",
+		Help: "HTTP requests by route, status and resolved view type",
+	}, []string{"route", "status", "view_type"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "curio_http_request_duration_seconds",
+		Help:    "HTTP request latency by route and resolved view type",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "view_type"})
+
+	upstreamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "curio_upstream_requests_total",
+		Help: "Calls to upstream backends by backend and outcome",
+	}, []string{"backend", "status"})
+
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "curio_upstream_request_duration_seconds",
+		Help:    "Upstream call latency by backend",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend"})
+
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "curio_cache_lookups_total",
+		Help: "Cache lookups by cache and result (hit or miss)",
+	}, []string{"cache", "result"})
+
+	invalidTrees = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "curio_archivematica_invalid_trees_total",
+		Help: "Archivematica trees that failed validation when viewed",
+	})
+
+	oembedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "curio_oembed_requests_total",
+		Help: "oEmbed responses by format and resolved view type",
+	}, []string{"format", "view_type"})
+)
+
+// metricsHandler exposes the metrics in the prometheus format
+var metricsHandler = gin.WrapH(promhttp.Handler())
+
+// metricsMiddleware records the count and latency of every request
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		viewType := c.GetString(viewTypeKey)
+		if viewType == "" {
+			viewType = "none"
+		}
+		httpRequests.WithLabelValues(route, strconv.Itoa(c.Writer.Status()), viewType).Inc()
+		httpDuration.WithLabelValues(route, viewType).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeUpstream records the outcome and latency of a single attempt to call a backend
+func observeUpstream(backend string, start time.Time, err error) {
+	upstreamDuration.WithLabelValues(backend).Observe(time.Since(start).Seconds())
+	upstreamRequests.WithLabelValues(backend, upstreamStatusLabel(err)).Inc()
+}
+
+// upstreamStatusLabel is the status code of the upstream response, or a description of why there
+// was no response
+func upstreamStatusLabel(err error) string {
+	if err == nil {
+		return "200"
+	}
+	var upErr *UpstreamError
+	if !errors.As(err, &upErr) {
+		return "error"
+	}
+	switch {
+	case errors.Is(upErr.Err, errCircuitOpen):
+		return "circuit_open"
+	case upErr.StatusCode > 0:
+		return strconv.Itoa(upErr.StatusCode)
+	case upErr.Timeout():
+		return "timeout"
+	}
+	return "error"
+}
+
+func observeCacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookups.WithLabelValues(cache, result).Inc()
+}
+
+//
+// end of file
+//
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// objectStore is the storage holding the Archivematica trees. Keys are relative to the root of the
+// store. Failures are returned as an *UpstreamError, with a 404 status for objects that do not exist.
+type objectStore interface {
+	Name() string
+	URL(key string) string
+	GetObject(ctx context.Context, key string) ([]byte, error)
+	List(ctx context.Context) ([]string, error)
+	Check(ctx context.Context) error
+}
+
+// the object store used by curio
+var store objectStore
+
+// storeLocation is the configured location of the Archivematica trees, like s3://bucket/prefix or
+// file:///data/am. It falls back to the root of the archivematica bucket.
+func storeLocation() string {
+	if config.archivematicaStore != "" {
+		return config.archivematicaStore
+	}
+	return fmt.Sprintf("s3://%s", config.archivematicaBucket)
+}
+
+func initStore() {
+	if replayingFixtures() {
+		return
+	}
+	var err error
+	store, err = newObjectStore(storeLocation())
+	if err != nil {
+		fatal("unable to create object store", "location", storeLocation(), "error", err.Error())
+	}
+}
+
+// newObjectStore creates the store for a location URL
+func newObjectStore(location string) (objectStore, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("no bucket in %s", location)
+		}
+		return newS3ObjectStore(u.Host, strings.Trim(u.Path, "/"))
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("no directory in %s", location)
+		}
+		return &localObjectStore{dir: filepath.FromSlash(u.Path)}, nil
+	}
+	return nil, fmt.Errorf("unsupported object store %s", location)
+}
+
+// s3ObjectStore reads objects below a prefix of an S3 bucket. Setting an endpoint points it at an
+// S3-compatible service such as MinIO instead of AWS.
+type s3ObjectStore struct {
+	svc    *s3.S3
+	bucket string
+	prefix string
+}
+
+func newS3ObjectStore(bucket string, prefix string) (*s3ObjectStore, error) {
+	awsCfg := aws.NewConfig()
+	if config.s3Endpoint != "" {
+		awsCfg = awsCfg.WithEndpoint(config.s3Endpoint)
+	}
+	awsCfg = awsCfg.WithS3ForcePathStyle(config.s3PathStyle)
+	sess, err := session.NewSession(awsCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &s3ObjectStore{svc: s3.New(sess), bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *s3ObjectStore) Name() string {
+	if config.s3Endpoint != "" {
+		return "s3-compatible"
+	}
+	return "s3"
+}
+
+func (s *s3ObjectStore) key(key string) string {
+	return path.Join(s.prefix, key)
+}
+
+func (s *s3ObjectStore) URL(key string) string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.key(key))
+}
+
+func (s *s3ObjectStore) GetObject(ctx context.Context, key string) ([]byte, error) {
+	out, err := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if err != nil {
+		return nil, s3Error(s.URL(key), err)
+	}
+	defer out.Body.Close()
+
+	buf, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, &UpstreamError{Backend: storageBackend.name, URL: s.URL(key), Err: err}
+	}
+	return buf, nil
+}
+
+func (s *s3ObjectStore) List(ctx context.Context) ([]string, error) {
+	keys := make([]string, 0)
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(s.bucket)}
+	if s.prefix != "" {
+		input.Prefix = aws.String(s.prefix + "/")
+	}
+	err := s.svc.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.StringValue(obj.Key), aws.StringValue(input.Prefix)))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, s3Error(s.URL(""), err)
+	}
+	return keys, nil
+}
+
+func (s *s3ObjectStore) Check(ctx context.Context) error {
+	_, err := s.svc.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	if err != nil {
+		return s3Error(fmt.Sprintf("s3://%s", s.bucket), err)
+	}
+	return nil
+}
+
+// s3Error converts an AWS SDK error to an *UpstreamError
+func s3Error(s3URL string, err error) *UpstreamError {
+	upErr := &UpstreamError{Backend: storageBackend.name, URL: s3URL, Err: err}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		upErr.StatusCode = reqErr.StatusCode()
+	}
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == s3.ErrCodeNoSuchBucket) {
+		upErr.StatusCode = http.StatusNotFound
+	}
+	return upErr
+}
+
+// localObjectStore reads objects from a directory
+type localObjectStore struct {
+	dir string
+}
+
+func (l *localObjectStore) Name() string {
+	return "file"
+}
+
+// file is the file holding an object. The key is cleaned so it can not escape the directory.
+func (l *localObjectStore) file(key string) string {
+	return filepath.Join(l.dir, filepath.Clean("/"+key))
+}
+
+func (l *localObjectStore) URL(key string) string {
+	return "file://" + filepath.ToSlash(l.file(key))
+}
+
+func (l *localObjectStore) GetObject(ctx context.Context, key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(l.file(key))
+	if err != nil {
+		upErr := &UpstreamError{Backend: storageBackend.name, URL: l.URL(key), Err: err}
+		if errors.Is(err, os.ErrNotExist) {
+			upErr.StatusCode = http.StatusNotFound
+		}
+		return nil, upErr
+	}
+	return data, nil
+}
+
+func (l *localObjectStore) List(ctx context.Context) ([]string, error) {
+	return listFiles(l.dir, "")
+}
+
+func (l *localObjectStore) Check(ctx context.Context) error {
+	info, err := os.Stat(l.dir)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", l.dir)
+	}
+	if err != nil {
+		return &UpstreamError{Backend: storageBackend.name, URL: "file://" + filepath.ToSlash(l.dir), Err: err}
+	}
+	return nil
+}
+
+// listFiles lists the files below a directory that end with suffix, as slash separated paths
+// relative to the directory with the suffix removed
+func listFiles(dir string, suffix string) ([]string, error) {
+	keys := make([]string, 0)
+	err := filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(file, suffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, strings.TrimSuffix(filepath.ToSlash(rel), suffix))
+		return nil
+	})
+	if err != nil {
+		return nil, &UpstreamError{Backend: storageBackend.name, URL: "file://" + filepath.ToSlash(dir), Err: err}
+	}
+	return keys, nil
+}
+
+//
+// end of file
+//
@@ -2,10 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -17,11 +18,34 @@ import (
 type oembed struct {
 	Version     string `json:"version,omitempty" xml:"version,omitempty"`
 	Type        string `json:"type,omitempty" xml:"type,omitempty"`
+	Title       string `json:"title,omitempty" xml:"title,omitempty"`
 	HTML        string `json:"html,omitempty" xml:"html,omitempty"`
 	Width       string `json:"width,omitempty" xml:"width,omitempty"`
 	Height      string `json:"height,omitempty" xml:"height,omitempty"`
 	Provider    string `json:"provider,omitempty" xml:"provider,omitempty"`
 	ProviderURL string `json:"provider_url,omitempty" xml:"provider_url,omitempty"`
+
+	// FileCount is the number of files in an embedded Archivematica collection
+	FileCount int `json:"file_count,omitempty" xml:"file_count,omitempty"`
+}
+
+// newOEmbed creates a rich oEmbed response from the configured provider
+func newOEmbed() oembed {
+	return oembed{Version: "1.0", Type: "rich", Provider: config.providerName, ProviderURL: config.providerURL}
+}
+
+// viewURL is the public URL of the Curio view of a PID
+func viewURL(pid string) string {
+	return expandPattern(config.viewURLPattern, map[string]string{"host": config.hostname, "pid": pid})
+}
+
+// expandPattern replaces each {name} placeholder in a configured URL pattern with its value
+func expandPattern(pattern string, values map[string]string) string {
+	pairs := make([]string, 0, len(values)*2)
+	for name, val := range values {
+		pairs = append(pairs, "{"+name+"}", val)
+	}
+	return strings.NewReplacer(pairs...).Replace(pattern)
 }
 
 // custom marshal that doesn't do the weird escaling of < >
@@ -47,14 +71,58 @@ type embedWSLSData struct {
 	SourceURI string
 }
 
+type embedArchivematicaData struct {
+	Width  string
+	Height string
+	URL    string
+	Title  string
+}
+
+// the templates used to render embed snippets, by file name
+var embedTemplates = make(map[string]*template.Template)
+
+// the template files that must be present in the templates directory
+var embedTemplateFiles = []string{"image_embed.html", "wsls_embed.html", "archivematica_embed.html"}
+
+// loadTemplates parses all of the embed snippet templates
+func loadTemplates() error {
+	for _, name := range embedTemplateFiles {
+		tpl, err := template.ParseFiles(fmt.Sprintf("templates/%s", name))
+		if err != nil {
+			return err
+		}
+		embedTemplates[name] = tpl
+	}
+	return nil
+}
+
+func templatesLoaded() bool {
+	return len(embedTemplates) == len(embedTemplateFiles)
+}
+
+// renderSnippet renders the named embed template into a trimmed HTML snippet
+func renderSnippet(name string, data interface{}) (string, error) {
+	snippet, ok := embedTemplates[name]
+	if !ok {
+		return "", fmt.Errorf("template %s is not loaded", name)
+	}
+	var renderedSnip bytes.Buffer
+	if err := snippet.Execute(&renderedSnip, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(renderedSnip.String()), nil
+}
+
 // oEmbedHandler returns the oEmbed data for a view
 func oEmbedHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
 	// Get some optional params; format, maxWidth and maxHeight
 	respFormat := c.Query("format")
 	if respFormat == "" {
 		respFormat = "json"
 	}
-	log.Printf("oEmbed format requested: %s", respFormat)
+	slog.InfoContext(ctx, "oEmbed format requested", "format", respFormat)
 
 	maxWidth, err := strconv.Atoi(c.Query("maxwidth"))
 	if err != nil {
@@ -90,30 +158,42 @@ func oEmbedHandler(c *gin.Context) {
 	unitID := parsedURL.Query().Get("unit")
 	page, _ := strconv.Atoi(parsedURL.Query().Get("page"))
 
-	// See what type of resource is being requested: IIIF?
-	_, iiifErr := getIIIFManifestURL(pid, unitID)
-	if iiifErr == nil {
-		respData, err := getImageOEmbedData(pid, unitID, page, maxWidth, maxHeight)
-		renderResponse(c, respFormat, respData, err)
+	// See what type of resource is being requested using the same resolvers as the view
+	resp, err := resolvers.resolve(ctx, pid, resolveParams{Unit: unitID, Page: page})
+	if err != nil {
+		if isNotFound(err) {
+			slog.InfoContext(ctx, "unable to resolve", "pid", pid, "error", err.Error())
+			c.String(http.StatusNotExtended, "resource not found")
+			return
+		}
+		slog.ErrorContext(ctx, "unable to resolve", "pid", pid, "error", err.Error())
+		status := errorStatus(err)
+		c.String(status, http.StatusText(status))
 		return
 	}
 
-	// Nope; try Apollo WSLS:
-	_, err = getApolloWSLSMetadata(pid)
-	if err == nil {
-		respData, err := getWSLSOEmbedData(parsedURL, maxWidth, maxHeight)
+	c.Set(viewTypeKey, resp.Type)
+	switch resp.Type {
+	case "iiif":
+		respData, err := getImageOEmbedData(ctx, pid, unitID, page, maxWidth, maxHeight)
 		renderResponse(c, respFormat, respData, err)
-		return
+	case "wsls":
+		respData, err := getWSLSOEmbedData(ctx, parsedURL, maxWidth, maxHeight)
+		renderResponse(c, respFormat, respData, err)
+	case "archivematica":
+		respData, err := getArchivematicaOEmbedData(ctx, pid, resp, parsedURL.Query().Get("node"), maxWidth, maxHeight)
+		renderResponse(c, respFormat, respData, err)
+	default:
+		slog.InfoContext(ctx, "oEmbed is not supported for resource type", "pid", pid, "type", resp.Type)
+		c.String(http.StatusNotExtended, "resource not found")
 	}
-
-	// Nope: fail
-	c.String(http.StatusNotExtended, "resource not found")
 }
 
 func renderResponse(c *gin.Context, fmt string, oembed oembed, err error) {
 	if err != nil {
 		c.String(http.StatusInternalServerError, err.Error())
 	} else {
+		oembedRequests.WithLabelValues(fmt, c.GetString(viewTypeKey)).Inc()
 		if fmt == "json" {
 			c.Header("content-type", "application/json; charset=utf-8")
 			c.String(http.StatusOK, oembed.marshalJSON())
@@ -123,10 +203,10 @@ func renderResponse(c *gin.Context, fmt string, oembed oembed, err error) {
 	}
 }
 
-func getImageOEmbedData(pid string, unitID string, page int, maxWidth int, maxHeight int) (oembed, error) {
-	respData := oembed{Version: "1.0", Type: "rich", Provider: "UVA Library", ProviderURL: "http://www.library.virginia.edu/"}
+func getImageOEmbedData(ctx context.Context, pid string, unitID string, page int, maxWidth int, maxHeight int) (oembed, error) {
+	respData := newOEmbed()
 	var imgData embedImageData
-	url := fmt.Sprintf("https://%s/view/%s", config.hostname, pid)
+	url := viewURL(pid)
 	if unitID != "" {
 		url = fmt.Sprintf("%s?unit=%s", url, unitID)
 	}
@@ -139,30 +219,27 @@ func getImageOEmbedData(pid string, unitID string, page int, maxWidth int, maxHe
 		} else {
 			url = fmt.Sprintf("%s?page=%d", url, page)
 		}
-		log.Printf("INFO: requested starting page index %d", page)
+		slog.InfoContext(ctx, "requested starting page index", "page", page)
 	}
-	log.Printf("INFO: Target oembed URL: %s", url)
+	slog.InfoContext(ctx, "target oEmbed URL", "url", url)
 	imgData.URL = url
 
-	// default embed size is 100% x 600px. Params maxwidth and maxheight can override.
-	imgData.Width = "100%"
+	// default embed size is configured (100% x 600px unless changed). Params maxwidth and maxheight can override.
+	imgData.Width = config.imageEmbedWidth
 	if maxWidth > 0 {
 		imgData.Width = fmt.Sprintf("%dpx", maxWidth)
 	}
-	imgData.Height = "600px"
+	imgData.Height = config.imageEmbedHeight
 	if maxHeight > 0 {
 		imgData.Height = fmt.Sprintf("%dpx", maxHeight)
 	}
 
 	// Render the <div> that will be included in the response, and used to embed the resource
-	log.Printf("INFO: rendering html snippet...")
-	var renderedSnip bytes.Buffer
-	snippet := template.Must(template.ParseFiles("templates/image_embed.html"))
-	snipErr := snippet.Execute(&renderedSnip, imgData)
+	slog.DebugContext(ctx, "rendering html snippet")
+	rawHTML, snipErr := renderSnippet("image_embed.html", imgData)
 	if snipErr != nil {
 		return respData, snipErr
 	}
-	rawHTML := strings.TrimSpace(renderedSnip.String())
 
 	respData.HTML = rawHTML
 	respData.Width = imgData.Width
@@ -170,30 +247,62 @@ func getImageOEmbedData(pid string, unitID string, page int, maxWidth int, maxHe
 	return respData, nil
 }
 
-func getWSLSOEmbedData(tgtURL *url.URL, maxWidth int, maxHeight int) (oembed, error) {
-	respData := oembed{Version: "1.0", Type: "rich", Provider: "UVA Library", ProviderURL: "http://www.library.virginia.edu/"}
+func getWSLSOEmbedData(ctx context.Context, tgtURL *url.URL, maxWidth int, maxHeight int) (oembed, error) {
+	respData := newOEmbed()
 	var snipData embedWSLSData
 
 	snipData.SourceURI = tgtURL.String()
-	snipData.Width = "670px"
+	snipData.Width = config.wslsEmbedWidth
 	if maxWidth > 0 {
 		snipData.Width = fmt.Sprintf("%dpx", maxWidth)
 	}
-	snipData.Height = "800px"
+	snipData.Height = config.wslsEmbedHeight
 	if maxHeight > 0 {
-		snipData.Height = fmt.Sprintf("%dpx", maxWidth)
+		snipData.Height = fmt.Sprintf("%dpx", maxHeight)
 	}
 
-	log.Printf("INFO: rendering html snippet...")
-	var renderedSnip bytes.Buffer
-	snippet := template.Must(template.ParseFiles("templates/wsls_embed.html"))
-	snipErr := snippet.Execute(&renderedSnip, snipData)
+	slog.DebugContext(ctx, "rendering html snippet")
+	rawHTML, snipErr := renderSnippet("wsls_embed.html", snipData)
+	if snipErr != nil {
+		return respData, snipErr
+	}
+
+	respData.HTML = rawHTML
+	respData.Width = snipData.Width
+	respData.Height = snipData.Height
+	return respData, nil
+}
+
+// getArchivematicaOEmbedData embeds the tree view of an Archivematica collection. The title and file
+// count come from the root of the tree; a node in the URL is passed on so the embed opens at it.
+func getArchivematicaOEmbedData(ctx context.Context, pid string, resp viewResponse, node string, maxWidth int, maxHeight int) (oembed, error) {
+	respData := newOEmbed()
+	var snipData embedArchivematicaData
+
+	snipData.URL = viewURL(pid)
+	if node != "" {
+		snipData.URL = fmt.Sprintf("%s?node=%s", snipData.URL, url.QueryEscape(node))
+	}
+	if root, ok := resp.Data.(TableNode); ok {
+		snipData.Title = root.Data.Name
+		respData.Title = root.Data.Name
+		respData.FileCount = root.Data.FileCount
+	}
+	snipData.Width = config.archivematicaEmbedWidth
+	if maxWidth > 0 {
+		snipData.Width = fmt.Sprintf("%dpx", maxWidth)
+	}
+	snipData.Height = config.archivematicaEmbedHeight
+	if maxHeight > 0 {
+		snipData.Height = fmt.Sprintf("%dpx", maxHeight)
+	}
+
+	slog.DebugContext(ctx, "rendering html snippet")
+	rawHTML, snipErr := renderSnippet("archivematica_embed.html", snipData)
 	if snipErr != nil {
 		return respData, snipErr
 	}
-	rawHTML := strings.TrimSpace(renderedSnip.String())
 
-	respData.Provider = "UVA Library"
 	respData.HTML = rawHTML
 	respData.Width = snipData.Width
 	respData.Height = snipData.Height
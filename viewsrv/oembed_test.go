@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestArchivematicaOEmbed(t *testing.T) {
+	env := newTestEnv(t)
+	env.addTree("am:1", testTreeJSON)
+	w := env.get("/oembed?url=" + url.QueryEscape("https://curio.test/view/am:1?node=abc"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("oembed status = %d: %s", w.Code, w.Body.String())
+	}
+	var resp oembed
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Title != "Papers" || resp.FileCount != 2 {
+		t.Errorf("oembed title = %q, file count = %d", resp.Title, resp.FileCount)
+	}
+	if !strings.Contains(resp.HTML, "https://curio.test/view/am:1?node=abc") {
+		t.Errorf("oembed does not open at the node: %s", resp.HTML)
+	}
+}
+
+func TestWSLSOEmbedSize(t *testing.T) {
+	env := newTestEnv(t)
+	env.addWSLS("uva-lib:1")
+	tests := []struct {
+		name   string
+		query  string
+		width  string
+		height string
+	}{
+		{"default", "", "670px", "800px"},
+		{"max width and height", "&maxwidth=300&maxheight=200", "300px", "200px"},
+		{"max height only", "&maxheight=200", "670px", "200px"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := env.get("/oembed?url=" + url.QueryEscape("https://curio.test/view/uva-lib:1") + tt.query)
+			if w.Code != http.StatusOK {
+				t.Fatalf("oembed status = %d: %s", w.Code, w.Body.String())
+			}
+			var resp oembed
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp.Width != tt.width || resp.Height != tt.height {
+				t.Errorf("oembed size = %s x %s, want %s x %s", resp.Width, resp.Height, tt.width, tt.height)
+			}
+		})
+	}
+}
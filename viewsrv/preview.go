@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errNotText is returned for a text file that is not UTF-8, which can not be previewed as text
+var errNotText = errors.New("not UTF-8 text")
+
+// filePreview is what the viewer needs to preview a file: a URL it can render inline or, for text
+// formats, the text itself
+type filePreview struct {
+	Key       string `json:"key"`
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	MimeType  string `json:"mimeType,omitempty"`
+	URL       string `json:"url,omitempty"`
+	Text      string `json:"text,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// archivematicaPreviewHandler returns the preview of a file. Images, PDFs, audio and video are
+// previewed from their own URL; text, CSV and JSON files are fetched and returned as text, up to
+// the preview size limit.
+func archivematicaPreviewHandler(c *gin.Context) {
+	pid := c.Param("pid")
+	key := c.Param("key")
+	ctx := c.Request.Context()
+	c.Set(viewTypeKey, "archivematica")
+	tree, err := getArchivematicaTree(ctx, pid)
+	if err != nil {
+		respondViewError(c, pid, err)
+		return
+	}
+	loc, ok := tree.find(key)
+	if !ok || len(loc.node.Entries) > 0 || loc.node.Type == "folder" {
+		c.String(http.StatusNotFound, "not found")
+		return
+	}
+
+	node := loc.node
+	format := lookupFormat(*node)
+	preview := filePreview{Key: key, Name: node.Name, Kind: format.Preview, MimeType: primaryMIMEType(node.MimeType)}
+	if node.SourceURL == "" {
+		preview.Kind = previewNone
+	}
+	switch preview.Kind {
+	case previewImage, previewPDF, previewAudio, previewVideo:
+		preview.URL = node.SourceURL
+	case previewText:
+		preview.Text, preview.Truncated, err = getPreviewText(ctx, node.SourceURL)
+		if errors.Is(err, errNotText) {
+			slog.InfoContext(ctx, "file can not be previewed as text", "pid", pid, "url", node.SourceURL, "error", err.Error())
+			preview.Kind = previewNone
+			break
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "unable to get preview text", "pid", pid, "url", node.SourceURL, "error", err.Error())
+			// the file is in the tree, so a file host that does not have it is failing rather than a 404
+			status := errorStatus(err)
+			if status == http.StatusNotFound {
+				status = http.StatusBadGateway
+			}
+			c.String(status, http.StatusText(status))
+			return
+		}
+		if !preview.Truncated && preview.MimeType == "application/json" {
+			preview.Text = indentJSON(preview.Text)
+		}
+	}
+	c.JSON(http.StatusOK, preview)
+}
+
+// getPreviewText gets the start of a text file, up to the preview size limit, using the response cache
+func getPreviewText(ctx context.Context, url string) (string, bool, error) {
+	buf, err := cachedResponse(ctx, "preview:"+url, func() ([]byte, error) {
+		return fetchPreviewText(ctx, url)
+	})
+	if err != nil {
+		return "", false, err
+	}
+	truncated := int64(len(buf)) > config.previewMaxBytes
+	if truncated {
+		buf = buf[:config.previewMaxBytes]
+		// do not split a multi-byte character
+		for trim := 1; trim < utf8.UTFMax && len(buf) > 0 && !utf8.Valid(buf); trim++ {
+			buf = buf[:len(buf)-1]
+		}
+	}
+	if !utf8.Valid(buf) {
+		return "", false, fmt.Errorf("%s is %w", url, errNotText)
+	}
+	return string(buf), truncated, nil
+}
+
+// fetchPreviewText reads one byte past the preview limit so a truncated file can be recognized. The
+// whole fetch must finish within the preview timeout, as the preview is small.
+func fetchPreviewText(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.previewTimeout)*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, &UpstreamError{Backend: "files", URL: url, Err: err}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, &UpstreamError{Backend: "files", URL: url, Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &UpstreamError{Backend: "files", URL: url, StatusCode: resp.StatusCode, Err: errors.New(http.StatusText(resp.StatusCode))}
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, config.previewMaxBytes+1))
+	if err != nil {
+		return nil, &UpstreamError{Backend: "files", URL: url, Err: err}
+	}
+	return buf, nil
+}
+
+// indentJSON pretty prints JSON, returning the original if it is not valid
+func indentJSON(text string) string {
+	var out bytes.Buffer
+	if err := json.Indent(&out, []byte(text), "", "  "); err != nil {
+		return text
+	}
+	return out.String()
+}
+
+//
+// end of file
+//
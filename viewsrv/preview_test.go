@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestArchivematicaPreview(t *testing.T) {
+	env := newTestEnv(t)
+	base := env.backend.URL()
+	env.backend.HandleText("/files/notes.txt", "caf\u00e9 notes")
+	env.backend.HandleSlow("/files/slow.txt", 5*time.Second, "too late")
+	env.backend.Handle("/files/latin.csv", http.StatusOK, "text/csv", []byte("name\nJos\xe9\n"))
+	env.addTree("am:1", fmt.Sprintf(`{"name": "t", "type": "folder", "entries": [
+		{"name": "notes.txt", "type": "file", "source_url": "%[1]s/files/notes.txt", "mime_types": "text/plain"},
+		{"name": "latin.csv", "type": "file", "source_url": "%[1]s/files/latin.csv", "mime_types": "text/csv"},
+		{"name": "gone.txt", "type": "file", "source_url": "%[1]s/files/gone.txt", "mime_types": "text/plain"},
+		{"name": "slow.txt", "type": "file", "source_url": "%[1]s/files/slow.txt", "mime_types": "text/plain"}]}`, base))
+
+	tests := []struct {
+		name   string
+		status int
+		kind   string
+		text   string
+	}{
+		{"notes.txt", http.StatusOK, previewText, "caf\u00e9 notes"},
+		{"latin.csv", http.StatusOK, previewNone, ""},
+		{"gone.txt", http.StatusBadGateway, "", ""},
+		{"slow.txt", http.StatusGatewayTimeout, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := env.get("/api/view/am:1/archivematica/preview/" + nodeKey("/t/"+tt.name))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var preview filePreview
+			json.Unmarshal(w.Body.Bytes(), &preview)
+			if preview.Kind != tt.kind || preview.Text != tt.text {
+				t.Errorf("preview kind = %q, text = %q", preview.Kind, preview.Text)
+			}
+		})
+	}
+}
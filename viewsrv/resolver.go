@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// resolveParams contains the optional request params that influence how a PID is resolved
+type resolveParams struct {
+	Unit string
+	Page int
+
+	// SourceURL is the backend URL from a previous resolution of the PID, if known
+	SourceURL string
+}
+
+// resolver determines if a PID is a specific type of resource and, if so, returns the view data for it.
+// A resolver that does not recognize the PID must return an error.
+type resolver interface {
+	Name() string
+	Resolve(ctx context.Context, pid string, params resolveParams) (viewResponse, error)
+}
+
+// errNotResolved is returned when no enabled resolver recognizes a PID
+var errNotResolved = errors.New("resource not found")
+
+// resolverRegistry is the ordered list of enabled resolvers shared by the view and oEmbed handlers
+type resolverRegistry struct {
+	resolvers []resolver
+}
+
+// global registry of resolvers
+var resolvers resolverRegistry
+
+// initResolvers builds the resolver registry from the configured resolver order, skipping
+// any that have been disabled
+func initResolvers() {
+	available := []resolver{&iiifResolver{}, &wslsResolver{}, &archivematicaResolver{}}
+	byName := make(map[string]resolver)
+	for _, r := range available {
+		byName[r.Name()] = r
+	}
+
+	disabled := make(map[string]bool)
+	for _, name := range splitList(config.disabledResolvers) {
+		if _, ok := byName[name]; !ok {
+			fatal("unknown resolver in disabled list", "resolver", name)
+		}
+		disabled[name] = true
+	}
+
+	resolvers.resolvers = make([]resolver, 0)
+	seen := make(map[string]bool)
+	for _, name := range splitList(config.resolverOrder) {
+		r, ok := byName[name]
+		if !ok {
+			fatal("unknown resolver in resolver order", "resolver", name)
+		}
+		if seen[name] {
+			fatal("resolver is listed more than once", "resolver", name)
+		}
+		seen[name] = true
+		if disabled[name] {
+			slog.Info("resolver is disabled", "resolver", name)
+			continue
+		}
+		resolvers.resolvers = append(resolvers.resolvers, r)
+	}
+
+	names := make([]string, 0)
+	for _, r := range resolvers.resolvers {
+		names = append(names, r.Name())
+	}
+	slog.Info("resolvers enabled", "order", strings.Join(names, ","))
+}
+
+// probeResult is the outcome of a single resolver probe
+type probeResult struct {
+	index int
+	resp  viewResponse
+	err   error
+}
+
+// resolve returns the view data for a PID. Known PIDs are sent directly to the resolver that handled
+// them last time; unknown PIDs are probed and the outcome is cached.
+func (reg *resolverRegistry) resolve(ctx context.Context, pid string, params resolveParams) (viewResponse, error) {
+	entry, ok := getCachedPIDResolution(pid, params)
+	observeCacheLookup("pid", ok)
+	if ok {
+		if !entry.Found {
+			slog.InfoContext(ctx, "pid is cached as not found", "pid", pid)
+			return viewResponse{}, errNotResolved
+		}
+		if r := reg.find(entry.Resolver); r != nil {
+			slog.InfoContext(ctx, "pid is cached", "pid", pid, "resolver", r.Name())
+			cachedParams := params
+			cachedParams.SourceURL = entry.SourceURL
+			resp, err := r.Resolve(ctx, pid, cachedParams)
+			if err == nil {
+				return resp, nil
+			}
+			if !isNotFound(err) {
+				// the backend is failing; probing the others would not tell us anything new
+				return viewResponse{}, err
+			}
+			slog.InfoContext(ctx, "cached resolution is stale", "pid", pid, "resolver", r.Name(), "error", err.Error())
+		}
+	}
+
+	resp, name, err := reg.probe(ctx, pid, params)
+	if err == nil {
+		cachePIDResolution(pid, params, name, resp.sourceURL)
+	} else if errors.Is(err, errNotResolved) {
+		cachePIDNotFound(pid, params)
+	}
+	return resp, err
+}
+
+// find returns the enabled resolver with the specified name, or nil
+func (reg *resolverRegistry) find(name string) resolver {
+	for _, r := range reg.resolvers {
+		if r.Name() == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// probe tries all enabled resolvers in parallel using a shared context. When more than one resolver
+// recognizes the PID, the one earliest in the configured order wins. As soon as the winner is known
+// the shared context is cancelled so the remaining probes can stop. If no resolver recognizes the PID
+// and any of them could not reach its backend, the backend failure is returned instead of errNotResolved
+// as the PID may well exist.
+func (reg *resolverRegistry) probe(ctx context.Context, pid string, params resolveParams) (viewResponse, string, error) {
+	probeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// buffered so that losing probes can finish without blocking after a winner is returned
+	results := make(chan probeResult, len(reg.resolvers))
+	for idx, r := range reg.resolvers {
+		go func(idx int, r resolver) {
+			slog.DebugContext(ctx, "probe resolver", "pid", pid, "resolver", r.Name())
+			spanCtx, span := startSpan(probeCtx, "resolve "+r.Name(), attribute.String("curio.pid", pid))
+			resp, err := r.Resolve(spanCtx, pid, params)
+			endSpan(span, err)
+			results <- probeResult{index: idx, resp: resp, err: err}
+		}(idx, r)
+	}
+
+	// outcomes are tracked by priority; next is the highest priority resolver with no outcome yet
+	outcomes := make([]*probeResult, len(reg.resolvers))
+	next := 0
+	var failure error
+	for range reg.resolvers {
+		select {
+		case <-ctx.Done():
+			slog.InfoContext(ctx, "resolve abandoned", "pid", pid, "error", ctx.Err().Error())
+			return viewResponse{}, "", ctx.Err()
+		case res := <-results:
+			outcomes[res.index] = &res
+		}
+
+		for next < len(outcomes) && outcomes[next] != nil {
+			r := reg.resolvers[next]
+			if outcomes[next].err == nil {
+				slog.InfoContext(ctx, "resolved", "pid", pid, "resolver", r.Name())
+				return outcomes[next].resp, r.Name(), nil
+			}
+			if isNotFound(outcomes[next].err) {
+				slog.DebugContext(ctx, "resolver did not match", "pid", pid, "resolver", r.Name(), "error", outcomes[next].err.Error())
+			} else {
+				slog.WarnContext(ctx, "resolver failed", "pid", pid, "resolver", r.Name(), "error", outcomes[next].err.Error())
+				if failure == nil {
+					failure = outcomes[next].err
+				}
+			}
+			next++
+		}
+	}
+	if failure != nil {
+		return viewResponse{}, "", failure
+	}
+	return viewResponse{}, "", errNotResolved
+}
+
+// iiifResolver handles PIDs that have a IIIF manifest
+type iiifResolver struct{}
+
+func (r *iiifResolver) Name() string {
+	return "iiif"
+}
+
+func (r *iiifResolver) Resolve(ctx context.Context, pid string, params resolveParams) (viewResponse, error) {
+	iiifManURL := params.SourceURL
+	if iiifManURL == "" {
+		var err error
+		iiifManURL, err = getIIIFManifestURL(ctx, pid, params.Unit)
+		if err != nil {
+			return viewResponse{}, err
+		}
+	}
+	return getImageViewData(ctx, iiifManURL, params.Page)
+}
+
+// wslsResolver handles WSLS PIDs that are described in Apollo
+type wslsResolver struct{}
+
+func (r *wslsResolver) Name() string {
+	return "wsls"
+}
+
+func (r *wslsResolver) Resolve(ctx context.Context, pid string, params resolveParams) (viewResponse, error) {
+	wslsData, err := getApolloWSLSMetadata(ctx, pid)
+	if err != nil {
+		return viewResponse{}, err
+	}
+	resp := getWSLSViewData(wslsData)
+	resp.sourceURL = apolloItemURL(pid)
+	return resp, nil
+}
+
+// archivematicaResolver handles PIDs that have an Archivematica tree in S3
+type archivematicaResolver struct{}
+
+func (r *archivematicaResolver) Name() string {
+	return "archivematica"
+}
+
+func (r *archivematicaResolver) Resolve(ctx context.Context, pid string, params resolveParams) (viewResponse, error) {
+	return getArchivematicaData(ctx, pid)
+}
+
+// splitList splits a comma separated config value into a list of trimmed, non-empty values
+func splitList(value string) []string {
+	out := make([]string, 0)
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+//
+// end of file
+//
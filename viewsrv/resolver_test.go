@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(env *testEnv)
+		resolver string
+		status   int
+	}{
+		{
+			name: "higher priority wins when it answers last",
+			setup: func(env *testEnv) {
+				env.addImage("pid:1")
+				manifest := `{"exists": true, "cached": true, "url": "` + env.backend.URL() + `/iiif/pid/pid:1"}`
+				env.backend.HandleSlow("/iiif/pid/pid:1/exist", 200*time.Millisecond, manifest)
+				env.addWSLS("pid:1")
+				env.addTree("pid:1", testTreeJSON)
+			},
+			resolver: "iiif",
+		},
+		{
+			name: "lower priority wins when the others do not match",
+			setup: func(env *testEnv) {
+				env.addTree("pid:1", testTreeJSON)
+			},
+			resolver: "archivematica",
+		},
+		{
+			name: "failure is ignored when a lower priority resolver matches",
+			setup: func(env *testEnv) {
+				env.backend.Handle("/iiif/pid/pid:1/exist", http.StatusInternalServerError, "text/plain", []byte("boom"))
+				env.addWSLS("pid:1")
+			},
+			resolver: "wsls",
+		},
+		{
+			name: "failure is returned when nothing matches",
+			setup: func(env *testEnv) {
+				env.backend.Handle("/apollo/items/pid:1", http.StatusInternalServerError, "text/plain", []byte("boom"))
+			},
+			status: http.StatusBadGateway,
+		},
+		{
+			name:   "not found when nothing matches",
+			status: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			if tt.setup != nil {
+				tt.setup(env)
+			}
+			_, name, err := resolvers.probe(context.Background(), "pid:1", resolveParams{})
+			if tt.resolver != "" {
+				if err != nil || name != tt.resolver {
+					t.Errorf("probe = %q, %v; want %q", name, err, tt.resolver)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("probe = %q; want an error", name)
+			}
+			if status := errorStatus(err); status != tt.status {
+				t.Errorf("probe error %v is a %d, want %d", err, status, tt.status)
+			}
+			if tt.status == http.StatusNotFound && !errors.Is(err, errNotResolved) {
+				t.Errorf("probe error = %v, want errNotResolved", err)
+			}
+		})
+	}
+}
+
+func TestProbeCancelsLosers(t *testing.T) {
+	env := newTestEnv(t)
+	env.addImage("pid:1")
+	env.backend.HandleSlow("/apollo/items/pid:1", 5*time.Second, `{}`)
+
+	start := time.Now()
+	_, name, err := resolvers.probe(context.Background(), "pid:1", resolveParams{})
+	if err != nil || name != "iiif" {
+		t.Fatalf("probe = %q, %v; want iiif", name, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("probe waited %s for a lower priority resolver", elapsed)
+	}
+	for wait := 0; env.backend.abandoned.Load() == 0 && wait < 100; wait++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if env.backend.abandoned.Load() != 1 {
+		t.Errorf("the losing wsls probe was not cancelled")
+	}
+}
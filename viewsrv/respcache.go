@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// responseCache stores raw upstream responses. Implementations may be local to the process
+// or shared between all Curio instances.
+type responseCache interface {
+	Name() string
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Remove(ctx context.Context, match func(key string) bool) (int, error)
+}
+
+// global cache of upstream responses; nil when response caching is disabled
+var respCache responseCache
+
+// initResponseCache creates the response cache described by the cache config. Supported values are
+// none, memory and a redis URL like redis://host:6379/0
+func initResponseCache() {
+	var err error
+	respCache, err = newResponseCache(config.responseCache)
+	if err != nil {
+		fatal("unable to create response cache", "error", err.Error())
+	}
+	if respCache == nil {
+		slog.Info("upstream response caching is disabled")
+		return
+	}
+	slog.Info("caching upstream responses", "cache", respCache.Name())
+}
+
+func newResponseCache(cfg string) (responseCache, error) {
+	switch {
+	case cfg == "" || cfg == "none":
+		return nil, nil
+	case cfg == "memory":
+		return newMemoryResponseCache(config.responseCacheSize, config.responseCacheBytes), nil
+	case strings.HasPrefix(cfg, "redis://") || strings.HasPrefix(cfg, "rediss://"):
+		return newRedisResponseCache(cfg)
+	}
+	return nil, fmt.Errorf("unsupported response cache %s", cfg)
+}
+
+// cachedResponse returns the cached response for key, or calls fetch and caches the result. Cache
+// failures are logged and treated as a miss so the cache can never take down a view.
+func cachedResponse(ctx context.Context, key string, fetch func() ([]byte, error)) ([]byte, error) {
+	if respCache == nil {
+		return fetch()
+	}
+
+	cached, found, err := respCache.Get(ctx, key)
+	observeCacheLookup("response", err == nil && found)
+	if err != nil {
+		slog.WarnContext(ctx, "response cache get failed", "cache", respCache.Name(), "key", key, "error", err.Error())
+	} else if found {
+		slog.InfoContext(ctx, "response cache hit", "cache", respCache.Name(), "key", key)
+		return cached, nil
+	}
+
+	resp, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := time.Duration(config.responseCacheTTL) * time.Second
+	if err := respCache.Set(ctx, key, resp, ttl); err != nil {
+		slog.WarnContext(ctx, "response cache set failed", "cache", respCache.Name(), "key", key, "error", err.Error())
+	}
+	return resp, nil
+}
+
+// memoryResponseCache keeps responses in this process only. It is bounded by the total size of the
+// responses as well as their number, as whole Archivematica trees can be tens of megabytes.
+type memoryResponseCache struct {
+	cache *ttlCache[[]byte]
+}
+
+func newMemoryResponseCache(maxSize int, maxBytes int64) *memoryResponseCache {
+	sizeOf := func(value []byte) int64 { return int64(len(value)) }
+	return &memoryResponseCache{cache: newSizedTTLCache[[]byte](maxSize, maxBytes, sizeOf)}
+}
+
+func (mc *memoryResponseCache) Name() string {
+	return "memory"
+}
+
+func (mc *memoryResponseCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	val, found := mc.cache.get(key)
+	return val, found, nil
+}
+
+func (mc *memoryResponseCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	mc.cache.set(key, value, ttl)
+	return nil
+}
+
+func (mc *memoryResponseCache) Remove(ctx context.Context, match func(key string) bool) (int, error) {
+	return mc.cache.removeIf(func(key string, value []byte) bool { return match(key) }), nil
+}
+
+// redisResponseCache shares responses between instances using any server that speaks the redis protocol
+type redisResponseCache struct {
+	client *redis.Client
+}
+
+// redisKeyPrefix keeps Curio keys separate from anything else stored in a shared redis
+const redisKeyPrefix = "curio:"
+
+func newRedisResponseCache(redisURL string) (*redisResponseCache, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %s", err.Error())
+	}
+	opts.DialTimeout = 2 * time.Second
+	opts.ReadTimeout = 1 * time.Second
+	opts.WriteTimeout = 1 * time.Second
+	return &redisResponseCache{client: redis.NewClient(opts)}, nil
+}
+
+func (rc *redisResponseCache) Name() string {
+	return "redis"
+}
+
+func (rc *redisResponseCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	val, err := rc.client.Get(ctx, redisKeyPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return val, true, nil
+}
+
+func (rc *redisResponseCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return rc.client.Set(ctx, redisKeyPrefix+key, value, ttl).Err()
+}
+
+// Remove scans every Curio key, deleting those that match. This is only used by the admin purge, so
+// the cost of a full scan is acceptable.
+func (rc *redisResponseCache) Remove(ctx context.Context, match func(key string) bool) (int, error) {
+	removed := 0
+	iter := rc.client.Scan(ctx, 0, redisKeyPrefix+"*", 500).Iterator()
+	for iter.Next(ctx) {
+		key := strings.TrimPrefix(iter.Val(), redisKeyPrefix)
+		if !match(key) {
+			continue
+		}
+		if err := rc.client.Del(ctx, iter.Val()).Err(); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, iter.Err()
+}
+
+//
+// end of file
+//
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisResponseCache(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rc, err := newRedisResponseCache("redis://" + mr.Addr() + "/0")
+	if err != nil {
+		t.Fatalf("newRedisResponseCache: %v", err)
+	}
+	ctx := context.Background()
+
+	if _, found, err := rc.Get(ctx, "api:missing"); err != nil || found {
+		t.Fatalf("Get of missing key = found %v, err %v", found, err)
+	}
+
+	for _, key := range []string{"api:one", "api:two", "store:one"} {
+		if err := rc.Set(ctx, key, []byte(key+" body"), time.Minute); err != nil {
+			t.Fatalf("Set %s: %v", key, err)
+		}
+	}
+	if !mr.Exists(redisKeyPrefix + "api:one") {
+		t.Errorf("key not stored under the %s prefix", redisKeyPrefix)
+	}
+	val, found, err := rc.Get(ctx, "api:one")
+	if err != nil || !found || string(val) != "api:one body" {
+		t.Errorf("Get api:one = %q, %v, %v", val, found, err)
+	}
+
+	mr.FastForward(2 * time.Minute)
+	if _, found, _ := rc.Get(ctx, "api:one"); found {
+		t.Errorf("api:one should have expired")
+	}
+
+	rc.Set(ctx, "api:one", []byte("1"), time.Minute)
+	rc.Set(ctx, "api:two", []byte("2"), time.Minute)
+	rc.Set(ctx, "store:one", []byte("3"), time.Minute)
+	mr.Set("other:api:one", "not ours")
+	removed, err := rc.Remove(ctx, func(key string) bool { return strings.HasPrefix(key, "api:") })
+	if err != nil || removed != 2 {
+		t.Errorf("Remove = %d, %v; want 2", removed, err)
+	}
+	if _, found, _ := rc.Get(ctx, "store:one"); !found {
+		t.Errorf("Remove deleted a key that did not match")
+	}
+	if !mr.Exists("other:api:one") {
+		t.Errorf("Remove deleted a key outside the %s prefix", redisKeyPrefix)
+	}
+}
+
+func TestRedisResponseCacheUnavailable(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rc, _ := newRedisResponseCache("redis://" + mr.Addr() + "/0")
+	mr.Close()
+
+	// cachedResponse must fall back to the upstream when redis is down
+	respCache = rc
+	defer func() { respCache = nil }()
+	val, err := cachedResponse(context.Background(), "api:down", func() ([]byte, error) { return []byte("fresh"), nil })
+	if err != nil || string(val) != "fresh" {
+		t.Errorf("cachedResponse = %q, %v", val, err)
+	}
+}
+
+func TestMemoryResponseCacheBytes(t *testing.T) {
+	mc := newMemoryResponseCache(100, 10)
+	ctx := context.Background()
+
+	mc.Set(ctx, "a", []byte("1234"), time.Minute)
+	mc.Set(ctx, "b", []byte("1234"), time.Minute)
+	mc.Set(ctx, "c", []byte("1234"), time.Minute)
+	if _, found, _ := mc.Get(ctx, "a"); found {
+		t.Errorf("least recently used entry should be evicted when over the byte budget")
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, found, _ := mc.Get(ctx, key); !found {
+			t.Errorf("%s should still be cached", key)
+		}
+	}
+
+	mc.Set(ctx, "huge", []byte("12345678901"), time.Minute)
+	if _, found, _ := mc.Get(ctx, "huge"); found {
+		t.Errorf("value bigger than the whole budget should not be cached")
+	}
+	if _, found, _ := mc.Get(ctx, "b"); !found {
+		t.Errorf("an uncacheable value should not evict anything")
+	}
+
+	mc.Set(ctx, "b", []byte("123456789"), time.Minute)
+	if _, found, _ := mc.Get(ctx, "c"); found {
+		t.Errorf("replacing a value should account for its new size")
+	}
+	if mc.cache.bytes != 9 {
+		t.Errorf("cache holds %d bytes, want 9", mc.cache.bytes)
+	}
+}
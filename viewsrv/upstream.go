@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// upstream is a backend service called by Curio. Every call to it is bounded by its timeout,
+// retried on transient failures and guarded by a circuit breaker.
+type upstream struct {
+	name    string
+	timeout time.Duration
+	breaker *circuitBreaker
+}
+
+// the upstream backends
+var (
+	iiifBackend    = &upstream{name: "iiifman"}
+	apolloBackend  = &upstream{name: "apollo"}
+	rightsBackend  = &upstream{name: "rights"}
+	wslsBackend    = &upstream{name: "wsls"}
+	storageBackend = &upstream{name: "storage"}
+)
+
+// all upstream backends, in the order they are reported
+var upstreams = []*upstream{iiifBackend, apolloBackend, rightsBackend, wslsBackend, storageBackend}
+
+// initUpstreams sets the per backend deadlines and circuit breakers from the config
+func initUpstreams() {
+	for _, u := range upstreams {
+		u.breaker = newCircuitBreaker(config.breakerThreshold, time.Duration(config.breakerCooldown)*time.Second)
+	}
+	iiifBackend.timeout = time.Duration(config.iiifTimeout) * time.Second
+	apolloBackend.timeout = time.Duration(config.apolloTimeout) * time.Second
+	rightsBackend.timeout = time.Duration(config.rightsTimeout) * time.Second
+	wslsBackend.timeout = time.Duration(config.wslsTimeout) * time.Second
+	storageBackend.timeout = time.Duration(config.s3Timeout) * time.Second
+}
+
+// withDeadline derives a context for a single call to the backend
+func (u *upstream) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if u.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, u.timeout)
+}
+
+// call makes a single logical call to the backend. Calls that fail because the backend is broken or
+// unreachable are retried with jittered exponential backoff; all calls are rejected while the circuit
+// breaker is open. The attempt function must return an *UpstreamError on failure.
+func (u *upstream) call(ctx context.Context, url string, attempt func(ctx context.Context) error) error {
+	for try := 0; ; try++ {
+		if u.breaker != nil {
+			if err := u.breaker.allow(); err != nil {
+				slog.WarnContext(ctx, "circuit is open; not calling backend", "backend", u.name, "url", url)
+				upstreamRequests.WithLabelValues(u.name, "circuit_open").Inc()
+				return &UpstreamError{Backend: u.name, URL: url, Err: err}
+			}
+		}
+
+		attemptCtx, cancel := u.withDeadline(ctx)
+		start := time.Now()
+		err := attempt(attemptCtx)
+		observeUpstream(u.name, start, err)
+		cancel()
+
+		if err == nil || !isBackendFailure(err) {
+			u.recordSuccess()
+			return err
+		}
+		if ctx.Err() != nil {
+			// the caller gave up; this says nothing about the health of the backend
+			if u.breaker != nil {
+				u.breaker.abandon()
+			}
+			return err
+		}
+		u.recordFailure()
+
+		if try >= config.retries {
+			return err
+		}
+		backoff := retryBackoff(try)
+		slog.WarnContext(ctx, "upstream call failed; retrying", "backend", u.name, "url", url, "retry", try+1, "retries", config.retries, "backoff", backoff.String())
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (u *upstream) recordSuccess() {
+	if u.breaker != nil {
+		u.breaker.success()
+	}
+}
+
+func (u *upstream) recordFailure() {
+	if u.breaker != nil {
+		u.breaker.failure()
+	}
+}
+
+// retryBackoff returns the delay before a retry, using full jitter on an exponential backoff
+func retryBackoff(try int) time.Duration {
+	base := time.Duration(config.retryBackoff) * time.Millisecond
+	if base <= 0 {
+		return 0
+	}
+	maxDelay := base << uint(try)
+	if maxDelay <= 0 || maxDelay > 10*time.Second {
+		maxDelay = 10 * time.Second
+	}
+	return time.Duration(rand.Int63n(int64(maxDelay))) + time.Millisecond
+}
+
+// isBackendFailure is true for errors that mean the backend is broken or unreachable, as opposed
+// to a backend that is working but has rejected the request (such as with a 404)
+func isBackendFailure(err error) bool {
+	var upErr *UpstreamError
+	if !errors.As(err, &upErr) {
+		return false
+	}
+	if errors.Is(upErr.Err, errCircuitOpen) {
+		return false
+	}
+	return upErr.StatusCode == 0 || (upErr.StatusCode >= 500 && upErr.StatusCode != http.StatusNotImplemented)
+}
+
+// UpstreamError describes a failed call to an upstream backend
+type UpstreamError struct {
+	Backend    string // name of the backend that failed
+	URL        string // URL that was requested
+	StatusCode int    // status returned by the backend; 0 if there was no response
+	Err        error  // underlying cause
+}
+
+func (e *UpstreamError) Error() string {
+	if e.StatusCode > 0 {
+		return fmt.Sprintf("%s: %s returned %d: %s", e.Backend, e.URL, e.StatusCode, e.Err.Error())
+	}
+	return fmt.Sprintf("%s: %s failed: %s", e.Backend, e.URL, e.Err.Error())
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// NotFound is true when the backend responded that the requested resource does not exist
+func (e *UpstreamError) NotFound() bool {
+	return e.StatusCode == http.StatusNotFound
+}
+
+// Timeout is true when the backend did not respond before the deadline
+func (e *UpstreamError) Timeout() bool {
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+// errNotFound is returned by resolvers when a backend responded but does not have the resource
+var errNotFound = errors.New("not found")
+
+// isNotFound is true when an error means the resource does not exist, rather than that
+// the backend could not be checked
+func isNotFound(err error) bool {
+	if errors.Is(err, errNotFound) || errors.Is(err, errNotResolved) {
+		return true
+	}
+	var upErr *UpstreamError
+	return errors.As(err, &upErr) && upErr.NotFound()
+}
+
+// errorStatus maps an error from view resolution to the HTTP status returned to the client
+func errorStatus(err error) int {
+	if isNotFound(err) {
+		return http.StatusNotFound
+	}
+	var treeErr *InvalidTreeError
+	if errors.As(err, &treeErr) {
+		return http.StatusUnprocessableEntity
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	var upErr *UpstreamError
+	if errors.As(err, &upErr) {
+		switch {
+		case upErr.Timeout():
+			return http.StatusGatewayTimeout
+		case upErr.StatusCode == 0 || upErr.StatusCode == http.StatusServiceUnavailable:
+			return http.StatusServiceUnavailable
+		}
+	}
+	return http.StatusBadGateway
+}
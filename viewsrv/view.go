@@ -1,21 +1,26 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type viewResponse struct {
 	Type string      `json:"type"`
 	Data interface{} `json:"data"`
+
+	// the backend URL the view data was resolved from
+	sourceURL string
 }
 
 type viewerData struct {
@@ -25,48 +30,57 @@ type viewerData struct {
 	PagePIDs  string `json:"page_pids"`
 }
 
-// viewHandler takes the initial viewer request and determines what type of resource it is and
-// hands the rendering off to the appropriate handler - or returns 404
+// viewHandler takes the initial viewer request and determines what type of resource it is using the
+// resolver registry. Returns 404 if the resource is unknown, 422 with the details if it is an
+// Archivematica tree that can not be displayed, or 502/503/504 if a backend needed to determine
+// that is failing.
 func viewHandler(c *gin.Context) {
 	srcPID := c.Param("pid")
-	unitID := c.Query("unit")
-	log.Printf("INFO: Check if %s is an image...", srcPID)
-	iiifManURL, iiifErr := getIIIFManifestURL(srcPID, unitID)
-	if iiifErr == nil {
-		log.Printf("INFO: render %s as image", srcPID)
-		viewImage(c, iiifManURL)
-		return
+	page, err := strconv.Atoi(c.Query("page"))
+	if err != nil {
+		page = 1
 	}
+	params := resolveParams{Unit: c.Query("unit"), Page: page}
 
-	// not an image; try Apollo for WSLS...
-	log.Printf("INFO: %s is not image; check WSLS", srcPID)
-	wslsData, err := getApolloWSLSMetadata(srcPID)
-	if err == nil {
-		log.Printf("INFO: render %s as WSLS", srcPID)
-		viewWSLS(c, wslsData)
+	ctx := c.Request.Context()
+	resp, err := resolvers.resolve(ctx, srcPID, params)
+	if err != nil {
+		respondViewError(c, srcPID, err)
 		return
 	}
+	c.Set(viewTypeKey, resp.Type)
+	c.JSON(http.StatusOK, resp)
+}
 
-	// Check Archivematica
-	log.Printf("INFO: %s is not WSLS; Checking Archivematica", srcPID)
-	archivematicaData, err := getArchivematicaData(srcPID)
-	if err == nil {
-		log.Printf("INFO: render %s as Archivematica", srcPID)
-		c.JSON(http.StatusOK, archivematicaData)
+// respondViewError sends the response for a PID that could not be viewed
+func respondViewError(c *gin.Context, pid string, err error) {
+	ctx := c.Request.Context()
+	status := errorStatus(err)
+	if status == http.StatusNotFound {
+		slog.InfoContext(ctx, "unable to resolve", "pid", pid, "error", err.Error())
+		c.String(status, "not found")
 		return
 	}
-
-	c.String(http.StatusNotFound, "not found")
+	var treeErr *InvalidTreeError
+	if errors.As(err, &treeErr) {
+		c.Set(viewTypeKey, "archivematica")
+		c.JSON(status, gin.H{"error": "invalid archivematica tree", "pid": pid, "problems": treeErr.Problems})
+		return
+	}
+	slog.ErrorContext(ctx, "unable to resolve", "pid", pid, "error", err.Error())
+	c.String(status, http.StatusText(status))
 }
 
-// viewImage displays a series of images in the universalViewer
-func viewImage(c *gin.Context, iiifURL string) {
-	log.Printf("INFO: using iiif manifest %s", iiifURL)
-	page, err := strconv.Atoi(c.Query("page"))
+// getImageViewData gets the data needed to display a series of images in the image viewer
+func getImageViewData(ctx context.Context, iiifURL string, page int) (resp viewResponse, err error) {
+	ctx, span := startSpan(ctx, "iiif.manifest", attribute.String("url.full", iiifURL))
+	defer func() { endSpan(span, err) }()
+
+	slog.InfoContext(ctx, "using iiif manifest", "url", iiifURL)
+	manifestStr, err := getAPIResponse(ctx, iiifBackend, iiifURL)
 	if err != nil {
-		page = 1
+		return viewResponse{}, err
 	}
-	manifestStr, err := getAPIResponse(iiifURL)
 
 	var manifest struct {
 		Sequences []struct {
@@ -76,9 +90,11 @@ func viewImage(c *gin.Context, iiifURL string) {
 		} `json:"sequences"`
 	}
 	if jErr := json.Unmarshal([]byte(manifestStr), &manifest); jErr != nil {
-		log.Printf("Unmarshal manifest failed: %s", jErr.Error())
-		c.String(http.StatusNotFound, "not found")
-		return
+		slog.ErrorContext(ctx, "unmarshal manifest failed", "url", iiifURL, "error", jErr.Error())
+		return viewResponse{}, jErr
+	}
+	if len(manifest.Sequences) == 0 {
+		return viewResponse{}, errors.New("manifest has no sequences")
 	}
 
 	// https://iiif.lib.virginia.edu/iiif/tsm:2804870/full/!200,200/0/default.jpg
@@ -90,38 +106,44 @@ func viewImage(c *gin.Context, iiifURL string) {
 	}
 
 	data := viewerData{RightsURI: config.rightsURL, IIIFURI: iiifURL, StartPage: page, PagePIDs: strings.Join(pids, ",")}
-	out := viewResponse{Type: "iiif", Data: data}
-	c.JSON(http.StatusOK, out)
+	return viewResponse{Type: "iiif", Data: data, sourceURL: iiifURL}, nil
 }
 
-// viewWSLS renders a custom view of WSLS content that includes video clips, transcripts and a poster
-func viewWSLS(c *gin.Context, wslsData *wslsMetadata) {
+// getWSLSViewData builds a custom view of WSLS content that includes video clips, transcripts and a poster
+func getWSLSViewData(wslsData *wslsMetadata) viewResponse {
 	if wslsData.HasVideo {
 		// POSTER: http://fedora01.lib.virginia.edu/wsls/{wslsID}/{wslsID}-poster.jpg
 		// VIDEO (webm): http://fedora01.lib.virginia.edu/wsls/{wslsID}/{wslsID}.mp4
-		wslsData.VideoURL = fmt.Sprintf("%s/%s/%s.mp4", config.wslsURL, wslsData.WSLSID, wslsData.WSLSID)
-		wslsData.PosterURL = fmt.Sprintf("%s/%s/%s-poster.jpg", config.wslsURL, wslsData.WSLSID, wslsData.WSLSID)
+		wslsData.VideoURL = wslsFileURL(config.wslsVideoPattern, wslsData.WSLSID)
+		wslsData.PosterURL = wslsFileURL(config.wslsPosterPattern, wslsData.WSLSID)
 	}
 
 	if wslsData.HasScript {
 		// PDF: http://fedora01.lib.virginia.edu/wsls/{wslsID}/{wslsID}.pdf
 		// Thumb: http://fedora01.lib.virginia.edu/wsls/{wslsID}/{wslsID}-script-thumbnail.jpg
 		// Transcript: http://fedora01.lib.virginia.edu/wsls/0003_1/0003_1.txt
-		wslsData.PDFURL = fmt.Sprintf("%s/%s/%s.pdf", config.wslsURL, wslsData.WSLSID, wslsData.WSLSID)
-		wslsData.PDFThumbURL = fmt.Sprintf("%s/%s/%s-script-thumbnail.jpg", config.wslsURL, wslsData.WSLSID, wslsData.WSLSID)
-		wslsData.TranscriptURL = fmt.Sprintf("%s/%s/%s.txt", config.wslsURL, wslsData.WSLSID, wslsData.WSLSID)
+		wslsData.PDFURL = wslsFileURL(config.wslsPDFPattern, wslsData.WSLSID)
+		wslsData.PDFThumbURL = wslsFileURL(config.wslsThumbPattern, wslsData.WSLSID)
+		wslsData.TranscriptURL = wslsFileURL(config.wslsTranscriptPattern, wslsData.WSLSID)
 	}
 
-	out := viewResponse{Type: "wsls", Data: wslsData}
-	c.JSON(http.StatusOK, out)
+	return viewResponse{Type: "wsls", Data: wslsData}
+}
+
+// wslsFileURL is the URL of a WSLS file, given its configured name pattern relative to the WSLS URL
+func wslsFileURL(pattern string, wslsID string) string {
+	return fmt.Sprintf("%s/%s", config.wslsURL, expandPattern(pattern, map[string]string{"id": wslsID}))
 }
 
 // getIIIFManifestURL retrieves the cached IIIF manifest for an item. If a unit is specified,
 // the manifest just needs to exist; cache does not matter as the manifest will be generated on the fly
-func getIIIFManifestURL(pid string, unit string) (string, error) {
-	log.Printf("INFO: check if %s, unitID [%s] is a candidate for IIIF metadata...", pid, unit)
+func getIIIFManifestURL(ctx context.Context, pid string, unit string) (manifestURL string, err error) {
+	ctx, span := startSpan(ctx, "iiif.exist", attribute.String("curio.pid", pid), attribute.String("curio.unit", unit))
+	defer func() { endSpan(span, err) }()
+
+	slog.InfoContext(ctx, "check if pid is a candidate for IIIF metadata", "pid", pid, "unit", unit)
 	url := fmt.Sprintf("%s/pid/%s/exist", config.iiifURL, pid)
-	resp, err := getAPIResponse(url)
+	resp, err := getAPIResponse(ctx, iiifBackend, url)
 	if err != nil {
 		return "", err
 	}
@@ -137,18 +159,18 @@ func getIIIFManifestURL(pid string, unit string) (string, error) {
 
 	// when unit is present, dont care if it is cached or not, just care if the metadata exists
 	if unit != "" {
-		log.Printf("Unit %s present in request, not using IIIF cache", unit)
+		slog.InfoContext(ctx, "unit present in request, not using IIIF cache", "unit", unit)
 		if parsed.Exists {
 			iiifURL := fmt.Sprintf("%s/pid/%s?unit=%s", config.iiifURL, pid, unit)
-			log.Printf("INFO: IIIF manifest available at %s", iiifURL)
+			slog.InfoContext(ctx, "IIIF manifest available", "url", iiifURL)
 			return iiifURL, nil
 		}
-		return "", errors.New("manifest not found")
+		return "", fmt.Errorf("manifest %w", errNotFound)
 	}
 	if !parsed.Exists || !parsed.Cached {
-		return "", errors.New("manifest not found")
+		return "", fmt.Errorf("manifest %w", errNotFound)
 	}
-	log.Printf("INFO: IIIF manifest cached at %s", parsed.URL)
+	slog.InfoContext(ctx, "IIIF manifest cached", "url", parsed.URL)
 	return parsed.URL, nil
 }
 
@@ -164,6 +186,14 @@ type ArchivematicaS3Node struct {
 	MimeType   string `json:"mime_types,omitempty"`
 	View       string `json:"view,omitempty"`
 
+	// technical and PREMIS metadata, present for files when Archivematica recorded it
+	Size          int64  `json:"size,omitempty"`
+	Checksum      string `json:"checksum,omitempty"`
+	ChecksumType  string `json:"checksum_type,omitempty"`
+	LastModified  string `json:"last_modified,omitempty"`
+	PUID          string `json:"puid,omitempty"`
+	FormatVersion string `json:"format_version,omitempty"`
+
 	Entries []ArchivematicaS3Node `json:"entries,omitempty"`
 }
 
@@ -174,7 +204,12 @@ type TableNode struct {
 	Data       ColumnData  `json:"data"`
 	Children   []TableNode `json:"children,omitempty"`
 	StyleClass string      `json:"styleClass,omitempty"`
-	//Leaf bool `json:"leaf"`
+	Leaf       bool        `json:"leaf"`
+
+	// HasChildren marks a folder whose children were left out; they are loaded from the node endpoint.
+	// TotalChildren is the number of children a folder has, which may be more than were included.
+	HasChildren   bool `json:"hasChildren,omitempty"`
+	TotalChildren int  `json:"totalChildren,omitempty"`
 }
 
 // ColumnData contains data to be displayed
@@ -184,42 +219,45 @@ type ColumnData struct {
 	Format string `json:"format"`
 	Icon   string `json:"icon"`
 	URL    string `json:"url"`
-}
 
-func getArchivematicaData(pid string) (viewResponse, error) {
-	ArchivematicaResponse := viewResponse{Type: "archivematica"}
+	// Preview is the kind of preview available for a file: image, pdf, audio, video, text or none
+	Preview string `json:"preview,omitempty"`
 
-	// S3 retrieval
-	fileName := fmt.Sprintf("%s.json", pid)
+	// file metadata
+	Size          int64  `json:"size,omitempty"`
+	Checksum      string `json:"checksum,omitempty"`
+	ChecksumType  string `json:"checksumType,omitempty"`
+	LastModified  string `json:"lastModified,omitempty"`
+	PUID          string `json:"puid,omitempty"`
+	FormatVersion string `json:"formatVersion,omitempty"`
 
-	resp, err := getS3Response(config.archivematicaBucket, fileName)
-	if err != nil {
-		return ArchivematicaResponse, err
-	}
+	// folder rollups of every file below the folder
+	FileCount int   `json:"fileCount,omitempty"`
+	TotalSize int64 `json:"totalSize,omitempty"`
+}
+
+func getArchivematicaData(ctx context.Context, pid string) (viewResponse, error) {
+	ArchivematicaResponse := viewResponse{Type: "archivematica", sourceURL: store.URL(archivematicaKey(pid))}
 
-	var S3Format ArchivematicaS3Node
-	err = json.Unmarshal(resp, &S3Format)
+	tree, err := getArchivematicaTree(ctx, pid)
 	if err != nil {
-		log.Fatal("Error during Unmarshal(): ", err)
+		return ArchivematicaResponse, err
 	}
 
-	// Convert to TreeNode
-
-	ArchivematicaResponse.Data = transformNode(S3Format, 0)
+	// Convert to TreeNode; deeper levels are loaded as folders are expanded
+	ArchivematicaResponse.Data = transformNode(tree.root, rootPath(tree.root), 0, config.treeDepth)
 
 	return ArchivematicaResponse, nil
 }
 
-// transformNode resursively converts the archivematica tree from S3 format to TreeNode
-func transformNode(s3Node ArchivematicaS3Node, depth int) TableNode {
+// transformNode resursively converts the archivematica tree from S3 format to TreeNode, down to
+// maxDepth. Only the first page of each folder's children is included. The path is the node's
+// path in the tree, which its key is derived from.
+func transformNode(s3Node ArchivematicaS3Node, path string, depth int, maxDepth int) TableNode {
 	var node TableNode
 	var data ColumnData
 
-	if len(s3Node.ID) > 0 {
-		node.Key = fmt.Sprintf("%d-%s", depth, s3Node.ID)
-	} else {
-		node.Key = fmt.Sprintf("%d-%s", depth, s3Node.Name)
-	}
+	node.Key = nodeKey(path)
 	data.Name = s3Node.Name
 	data.Type = s3Node.Type
 
@@ -231,28 +269,39 @@ func transformNode(s3Node ArchivematicaS3Node, depth int) TableNode {
 		data.Icon = "fa fa-file"
 		data.Format = s3Node.Format
 		data.URL = s3Node.SourceURL
+		data.Size = s3Node.Size
+		data.Checksum = s3Node.Checksum
+		data.ChecksumType = strings.ToLower(s3Node.ChecksumType)
+		data.LastModified = s3Node.LastModified
+		data.PUID = s3Node.PUID
+		data.FormatVersion = s3Node.FormatVersion
 	}
-
-	switch s3Node.View {
-	case "image":
-		data.Type = "image"
-		data.Icon = "fa fa-file-image"
+	if len(s3Node.Entries) > 0 {
+		data.FileCount, data.TotalSize = rollup(s3Node)
 	}
 
-	switch {
-	case strings.Contains(s3Node.Format, "PDF"):
-		data.Icon = "fa fa-file-pdf"
-	case strings.Contains(s3Node.Format, "Word"):
-		data.Icon = "fa fa-file-word"
-	case strings.Contains(s3Node.Format, "Excel"):
-		data.Icon = "fa fa-file-excel"
+	if s3Node.Type != "folder" && len(s3Node.Entries) == 0 {
+		format := lookupFormat(s3Node)
+		data.Icon = format.Icon
+		data.Preview = format.Preview
+		if format.Preview == previewImage {
+			data.Type = "image"
+		}
 	}
 
 	node.Data = data
 
 	//recursively transform children
-	for _, s3Child := range s3Node.Entries {
-		node.Children = append(node.Children, transformNode(s3Child, depth+1))
+	node.Leaf = len(s3Node.Entries) == 0
+	node.TotalChildren = len(s3Node.Entries)
+	if depth >= maxDepth {
+		node.HasChildren = !node.Leaf
+		return node
+	}
+	paths := childPaths(path, s3Node)
+	start, end := pageBounds(len(s3Node.Entries), 0, config.treePageSize)
+	for idx := start; idx < end; idx++ {
+		node.Children = append(node.Children, transformNode(s3Node.Entries[idx], paths[idx], depth+1, maxDepth))
 	}
 
 	return node